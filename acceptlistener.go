@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Backoff between retries of a transiently failing Accept, as in
+// net/http's Server.Serve.
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// Kinds of accept errors counted in listener_accept_errors_total.
+const (
+	acceptErrorTransient = "transient"
+	acceptErrorPermanent = "permanent"
+)
+
+// acceptListener retries Accept errors that are expected to clear up, such
+// as running out of file descriptors, after a backoff, so the server
+// neither spins nor gives up while connections are closed and descriptors
+// freed. Other errors are returned, for Serve to stop on. Both are logged
+// and counted under the listener's name.
+type acceptListener struct {
+	net.Listener
+	name string
+}
+
+func (l *acceptListener) Accept() (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		if errors.Is(err, net.ErrClosed) {
+			// The server is shutting down.
+			return nil, err
+		}
+		if !transientAcceptError(err) {
+			acceptErrors.WithLabelValues(l.name, acceptErrorPermanent).Inc()
+			log.Printf("%s listener: accept: %v", l.name, err)
+			return nil, err
+		}
+		acceptErrors.WithLabelValues(l.name, acceptErrorTransient).Inc()
+		if backoff == 0 {
+			backoff = minAcceptBackoff
+		} else if backoff *= 2; backoff > maxAcceptBackoff {
+			backoff = maxAcceptBackoff
+		}
+		log.Printf("%s listener: accept: %v; retrying in %s", l.name, err, backoff)
+		time.Sleep(backoff)
+	}
+}
+
+// transientAcceptError reports whether err from Accept is worth retrying:
+// descriptor or buffer exhaustion, a connection aborted before it was
+// accepted, or anything else the net package deems temporary.
+func transientAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// accessLogEntry is one access log record. Fields tagged omitempty are
+// only filled in at the debug log level or when present on the request.
+type accessLogEntry struct {
+	Time        string   `json:"time"`
+	RequestID   string   `json:"request_id"`
+	TraceID     string   `json:"trace_id,omitempty"`
+	ClientIP    string   `json:"client_ip"`
+	ClientIPSrc string   `json:"client_ip_source,omitempty"`
+	FwdProto    string   `json:"forwarded_proto,omitempty"`
+	FwdHost     string   `json:"forwarded_host,omitempty"`
+	FwdFor      []string `json:"forwarded_for,omitempty"`
+	OriginIP    string   `json:"origin_ip,omitempty"`
+	Method      string   `json:"method"`
+	URI         string   `json:"uri"`
+	Status      int      `json:"status"`
+	Bytes       int      `json:"bytes"`
+	DurationMs  float64  `json:"duration_ms"`
+	ContentType string   `json:"content_type,omitempty"`
+}
+
+// accessLogJSON writes JSON access log lines; each line carries its own
+// time field.
+var accessLogJSON = log.New(logOutput, "", 0)
+
+// writeAccessLog emits entry in the configured log format. Text lines go
+// through the request logger so they share its prefix.
+func writeAccessLog(c *Config, logger *log.Logger, entry accessLogEntry) {
+	if c.LogFormat == logFormatJSON {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			logger.Printf("json.Marshal(): %v", err)
+			return
+		}
+		accessLogJSON.Print(string(b))
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s %d %dB %.3fms", entry.ClientIP, entry.Method, entry.URI, entry.Status, entry.Bytes, entry.DurationMs)
+	if entry.FwdProto != "" {
+		fmt.Fprintf(&sb, " forwarded_proto=%s", entry.FwdProto)
+	}
+	if entry.FwdHost != "" {
+		fmt.Fprintf(&sb, " forwarded_host=%q", entry.FwdHost)
+	}
+	if len(entry.FwdFor) > 0 {
+		fmt.Fprintf(&sb, " forwarded_for=%s origin_ip=%s", strings.Join(entry.FwdFor, ","), entry.OriginIP)
+	}
+	if entry.ClientIPSrc != "" {
+		fmt.Fprintf(&sb, " client_ip_source=%s", entry.ClientIPSrc)
+	}
+	if entry.ContentType != "" {
+		fmt.Fprintf(&sb, " content_type=%q", entry.ContentType)
+	}
+	logger.Print(sb.String())
+}
+
+// logURI returns the path of u for the access log, followed by its query
+// when logQuery is set. Values of parameters whose names look sensitive,
+// as judged for /env, are redacted.
+func logURI(u *url.URL, logQuery bool) string {
+	path := u.EscapedPath()
+	if !logQuery || u.RawQuery == "" {
+		return path
+	}
+	params := strings.Split(u.RawQuery, "&")
+	for i, p := range params {
+		raw := strings.SplitN(p, "=", 2)[0]
+		name, err := url.QueryUnescape(raw)
+		if err != nil {
+			name = raw
+		}
+		if isSensitiveName(name) {
+			params[i] = raw + "=<redacted>"
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// withAccessLog assigns each request an ID, stores a logger tagged with it
+// in the request context and logs one line per request once the handler
+// returns. The client's X-Request-ID is reused when valid; only the first
+// one counts if several were sent, and an invalid one is replaced.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			if id != "" && currentConfig().LogLevel == logLevelDebug {
+				defaultLogger.Printf("replacing invalid X-Request-ID %q", id)
+			}
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		prefix := "req=" + id
+		if trace := getTraceID(r); trace != "" {
+			prefix += " trace=" + trace
+		}
+		logger := log.New(logOutput, prefix+" ", log.LstdFlags|log.Lmsgprefix)
+		ctx := context.WithValue(r.Context(), loggerKey, logger)
+		// withRoute fills in the matched route, which the request seen
+		// here never carries.
+		var rt route
+		ctx = context.WithValue(ctx, routeSlotKey, &rt)
+
+		sw := &statusWriter{
+			ResponseWriter: w,
+			status:         http.StatusOK,
+			start:          start,
+			timing:         currentConfig().ResponseTimeHeader,
+		}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		c := currentConfig()
+		clientIP, clientIPSrc := getClientIP(r)
+		entry := accessLogEntry{
+			Time:       start.Format(time.RFC3339Nano),
+			RequestID:  id,
+			TraceID:    getTraceID(r),
+			ClientIP:   clientIP,
+			Method:     r.Method,
+			URI:        logURI(r.URL, c.LogQuery),
+			Status:     sw.status,
+			Bytes:      sw.bytes,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if fwd, ok := getForwarded(r); ok {
+			entry.FwdProto = fwd.Proto
+			entry.FwdHost = fwd.Host
+		}
+		if hops := forwardedForHops(r); len(hops) > 0 {
+			entry.FwdFor = hops
+			entry.OriginIP = hops[0]
+		}
+		if c.LogLevel == logLevelDebug {
+			entry.ContentType = sw.Header().Get("Content-Type")
+			entry.ClientIPSrc = clientIPSrc
+		}
+		writeAccessLog(c, logger, entry)
+		if elapsed := time.Since(start); c.SlowRequest > 0 && elapsed > c.SlowRequest {
+			path := rt.pattern
+			if path == "" {
+				path = unroutedPath
+			}
+			slowRequests.WithLabelValues(path).Inc()
+			logger.Printf("WARNING: slow request: %s %s took %s, over SLOW_REQUEST_MS (%s)", r.Method, path, elapsed.Round(time.Millisecond), c.SlowRequest)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithAccessLogRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []string
+		want string // "" when a generated ID is expected
+	}{
+		{"none", nil, ""},
+		{"valid", []string{"abc-123"}, "abc-123"},
+		{"empty", []string{""}, ""},
+		{"overlong", []string{strings.Repeat("a", maxRequestIDLength+1)}, ""},
+		{"control chars", []string{"abc\x01def"}, ""},
+		{"first of two", []string{"first", "second"}, "first"},
+		{"invalid first of two", []string{"bad id", "second"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = w.Header().Get("X-Request-ID")
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, id := range tt.ids {
+				req.Header.Add("X-Request-ID", id)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Header().Get("X-Request-ID")
+			if got != seen {
+				t.Errorf("handler saw X-Request-ID %q, response has %q", seen, got)
+			}
+			if tt.want != "" {
+				if got != tt.want {
+					t.Errorf("X-Request-ID = %q, want %q", got, tt.want)
+				}
+				return
+			}
+			if !validRequestID(got) {
+				t.Errorf("generated X-Request-ID %q is not valid", got)
+			}
+			for _, id := range tt.ids {
+				if got == id {
+					t.Errorf("X-Request-ID = %q, want a generated one", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Outcomes recorded in the audit log.
+const (
+	auditAllowed       = "allowed"
+	auditDenied        = "denied"
+	auditNotConfigured = "not_configured"
+)
+
+type auditEntry struct {
+	Time      string `json:"time"`
+	RequestID string `json:"request_id,omitempty"`
+	ClientIP  string `json:"client_ip"`
+	Method    string `json:"method"`
+	Endpoint  string `json:"endpoint"`
+	Outcome   string `json:"outcome"`
+}
+
+// auditLog receives one JSON line per token-guarded request. It writes to
+// stdout until openAuditLog points it at AuditLog.
+var auditLog = log.New(logOutput, "audit: ", 0)
+
+// openAuditLog directs the audit log to dest: "" or "stdout", "stderr",
+// or a file appended to.
+func openAuditLog(dest string) error {
+	switch dest {
+	case "", "stdout":
+		return nil
+	case "stderr":
+		auditLog.SetOutput(os.Stderr)
+		return nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	auditLog.SetOutput(f)
+	auditLog.SetPrefix("")
+	return nil
+}
+
+// audit records the outcome of an access check on r.
+func audit(w http.ResponseWriter, r *http.Request, outcome string) {
+	ip, _ := getClientIP(r)
+	b, err := json.Marshal(auditEntry{
+		Time:      time.Now().Format(time.RFC3339Nano),
+		RequestID: w.Header().Get("X-Request-ID"),
+		ClientIP:  ip,
+		Method:    r.Method,
+		Endpoint:  r.URL.Path,
+		Outcome:   outcome,
+	})
+	if err != nil {
+		logFromCtx(r.Context()).Printf("audit: json.Marshal(): %v", err)
+		return
+	}
+	auditLog.Print(string(b))
+}
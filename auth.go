@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken checks that the request carries "Authorization: Bearer
+// <ADMIN_TOKEN>". It answers the request itself and returns false when the
+// check fails, including when no admin token is configured. Every check
+// is recorded in the audit log.
+func requireToken(w http.ResponseWriter, r *http.Request) bool {
+	token := currentConfig().AdminToken
+	if token == "" {
+		audit(w, r, auditNotConfigured)
+		rejectRequest(w, rejectUnauthorized, http.StatusForbidden, "admin token not configured")
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		audit(w, r, auditDenied)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		rejectRequest(w, rejectUnauthorized, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+		return false
+	}
+	audit(w, r, auditAllowed)
+	return true
+}
+
+// withMetricsAuth protects the metrics endpoint with a bearer token
+// (MetricsToken) or basic auth (MetricsUser/MetricsPassword) when either is
+// configured. With neither set it stays open for in-cluster scraping.
+func withMetricsAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if c.MetricsToken == "" && c.MetricsUser == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if c.MetricsToken != "" {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(c.MetricsToken)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		if c.MetricsUser != "" {
+			user, pass, ok := r.BasicAuth()
+			if ok && subtle.ConstantTimeCompare([]byte(user), []byte(c.MetricsUser)) == 1 &&
+				subtle.ConstantTimeCompare([]byte(pass), []byte(c.MetricsPassword)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+		}
+		rejectRequest(w, rejectUnauthorized, http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBodyFileSize bounds files served through BODY_FILE_<path>.
+const maxBodyFileSize = 1 << 20
+
+type bodyFile struct {
+	modTime time.Time
+	size    int64
+	data    []byte
+}
+
+// bodyFileCache holds override files by name, re-read when their mtime or
+// size changes.
+var bodyFileCache = struct {
+	sync.Mutex
+	files map[string]bodyFile
+}{files: map[string]bodyFile{}}
+
+// readBodyFile returns the contents of name, from the cache unless the
+// file changed since it was last read.
+func readBodyFile(name string) ([]byte, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() > maxBodyFileSize {
+		return nil, fmt.Errorf("%s: larger than %d bytes", name, maxBodyFileSize)
+	}
+	bodyFileCache.Lock()
+	cached, ok := bodyFileCache.files[name]
+	bodyFileCache.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) && cached.size == fi.Size() {
+		return cached.data, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxBodyFileSize))
+	if err != nil {
+		return nil, err
+	}
+	bodyFileCache.Lock()
+	bodyFileCache.files[name] = bodyFile{modTime: fi.ModTime(), size: fi.Size(), data: data}
+	bodyFileCache.Unlock()
+	return data, nil
+}
+
+// withBodyOverrides serves the file configured in BodyFiles for the
+// request path instead of calling next. Paths without an override, and
+// overrides whose file cannot be read, fall through to next.
+func withBodyOverrides(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := currentConfig().BodyFiles[r.URL.Path]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		data, err := readBodyFile(name)
+		if err != nil {
+			logFromCtx(r.Context()).Printf("BODY_FILE_%s: %v", r.URL.Path, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	})
+}
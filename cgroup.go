@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cgroupEntry is one line of /proc/self/cgroup.
+type cgroupEntry struct {
+	HierarchyID int      `json:"hierarchy_id"`
+	Controllers []string `json:"controllers,omitempty"`
+	Path        string   `json:"path"`
+}
+
+type cgroupInfo struct {
+	// Version is "v1", "v2" (unified only) or "hybrid".
+	Version     string        `json:"version"`
+	Cgroups     []cgroupEntry `json:"cgroups"`
+	ContainerID string        `json:"container_id,omitempty"`
+}
+
+// containerIDPattern matches the 64 hex digit IDs used by Docker,
+// containerd and CRI-O, as in /docker/<id>, docker-<id>.scope,
+// cri-containerd-<id>.scope and crio-<id>.scope.
+var containerIDPattern = regexp.MustCompile(`(?:^|[/:-])([0-9a-f]{64})(?:\.scope)?(?:/|$)`)
+
+// parseCgroups parses the contents of /proc/<pid>/cgroup.
+func parseCgroups(data string) cgroupInfo {
+	var info cgroupInfo
+	var v1, v2 bool
+	for _, line := range strings.Split(strings.TrimSpace(data), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		entry := cgroupEntry{HierarchyID: id, Path: fields[2]}
+		if fields[1] != "" {
+			entry.Controllers = strings.Split(fields[1], ",")
+		}
+		if id == 0 && fields[1] == "" {
+			v2 = true
+		} else {
+			v1 = true
+		}
+		info.Cgroups = append(info.Cgroups, entry)
+	}
+	switch {
+	case v1 && v2:
+		info.Version = "hybrid"
+	case v2:
+		info.Version = "v2"
+	default:
+		info.Version = "v1"
+	}
+	return info
+}
+
+// findContainerID returns the first container ID found in any of paths.
+func findContainerID(paths ...string) string {
+	for _, p := range paths {
+		if m := containerIDPattern.FindStringSubmatch(p); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// cgroupHandler reports the cgroups of this process and, best effort, the
+// ID of the container it runs in.
+func cgroupHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <cgroupHandler>", getOnelineInfo(r))
+
+	info, err := getCgroups()
+	if err == errUnsupportedPlatform {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+	if err != nil {
+		handlerError(r, errKindProcRead, "getCgroups()", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+func getCgroups() (cgroupInfo, error) {
+	data, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		procReadErrors.WithLabelValues("cgroup").Inc()
+		return cgroupInfo{}, err
+	}
+	info := parseCgroups(string(data))
+	var paths []string
+	for _, cg := range info.Cgroups {
+		paths = append(paths, cg.Path)
+	}
+	info.ContainerID = findContainerID(paths...)
+	if info.ContainerID == "" {
+		// With a private cgroup namespace, the usual case on cgroup v2, the
+		// paths are all "/". The runtime's bind mounts of /etc/hostname and
+		// friends still name the container directory.
+		if mounts, err := ioutil.ReadFile("/proc/self/mountinfo"); err == nil {
+			for _, line := range strings.Split(string(mounts), "\n") {
+				if fields := strings.Fields(line); len(fields) > 4 && strings.Contains(fields[3], "containers/") {
+					if id := findContainerID(fields[3]); id != "" {
+						info.ContainerID = id
+						break
+					}
+				}
+			}
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getCgroups() (cgroupInfo, error) {
+	return cgroupInfo{}, errUnsupportedPlatform
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// cgroupUnlimitedV1 is the smallest memory.limit_in_bytes treated as no
+// limit: cgroup v1 reports an unset limit as the largest page-aligned
+// int64, 9223372036854771712.
+const cgroupUnlimitedV1 = 1 << 62
+
+type cgroupCPULimits struct {
+	// QuotaMicros of CPU time may be used every PeriodMicros; Cores is
+	// their ratio. All three are absent without a quota.
+	QuotaMicros  *int64   `json:"quota_us,omitempty"`
+	PeriodMicros *int64   `json:"period_us,omitempty"`
+	Cores        *float64 `json:"cores,omitempty"`
+	Unlimited    bool     `json:"unlimited"`
+	// ThrottledPeriods and ThrottledSeconds come from cpu.stat.
+	ThrottledPeriods *int64   `json:"throttled_periods,omitempty"`
+	ThrottledSeconds *float64 `json:"throttled_seconds,omitempty"`
+}
+
+type cgroupMemoryLimits struct {
+	LimitBytes *int64 `json:"limit_bytes,omitempty"`
+	Unlimited  bool   `json:"unlimited"`
+	UsageBytes *int64 `json:"usage_bytes,omitempty"`
+}
+
+type cgroupLimits struct {
+	// Version is the hierarchy the limits were read from, "v1" or "v2".
+	Version string             `json:"version"`
+	CPU     cgroupCPULimits    `json:"cpu"`
+	Memory  cgroupMemoryLimits `json:"memory"`
+	// Missing lists the cgroup files that could not be read, leaving the
+	// values they hold out of the report.
+	Missing []string `json:"missing,omitempty"`
+}
+
+// cgroupFiles reads files by name from a cgroup directory.
+type cgroupFiles func(name string) (string, bool)
+
+// readCgroupLimits fills a cgroupLimits from the files of the given
+// version's hierarchy. cpu and memory read the directories of those
+// controllers, which on v2 are one and the same.
+func readCgroupLimits(version string, cpu, memory cgroupFiles) cgroupLimits {
+	limits := cgroupLimits{Version: version}
+	read := func(files cgroupFiles, name string) (string, bool) {
+		data, ok := files(name)
+		if !ok {
+			limits.Missing = append(limits.Missing, name)
+		}
+		return strings.TrimSpace(data), ok
+	}
+	if version == "v2" {
+		if data, ok := read(cpu, "cpu.max"); ok {
+			fields := strings.Fields(data)
+			if len(fields) == 2 {
+				limits.CPU.setQuota(parseCgroupInt(fields[0]), parseCgroupInt(fields[1]))
+			}
+		}
+		if data, ok := read(cpu, "cpu.stat"); ok {
+			stat := parseCgroupStat(data)
+			limits.CPU.ThrottledPeriods = stat["nr_throttled"]
+			if us := stat["throttled_usec"]; us != nil {
+				s := float64(*us) / 1e6
+				limits.CPU.ThrottledSeconds = &s
+			}
+		}
+		if data, ok := read(memory, "memory.max"); ok {
+			limits.Memory.LimitBytes = parseCgroupInt(data)
+			limits.Memory.Unlimited = limits.Memory.LimitBytes == nil
+		}
+		if data, ok := read(memory, "memory.current"); ok {
+			limits.Memory.UsageBytes = parseCgroupInt(data)
+		}
+		return limits
+	}
+
+	quota, qok := read(cpu, "cpu.cfs_quota_us")
+	period, pok := read(cpu, "cpu.cfs_period_us")
+	if qok && pok {
+		limits.CPU.setQuota(parseCgroupInt(quota), parseCgroupInt(period))
+	}
+	if data, ok := read(cpu, "cpu.stat"); ok {
+		stat := parseCgroupStat(data)
+		limits.CPU.ThrottledPeriods = stat["nr_throttled"]
+		if ns := stat["throttled_time"]; ns != nil {
+			s := float64(*ns) / 1e9
+			limits.CPU.ThrottledSeconds = &s
+		}
+	}
+	if data, ok := read(memory, "memory.limit_in_bytes"); ok {
+		if n := parseCgroupInt(data); n != nil && *n < cgroupUnlimitedV1 {
+			limits.Memory.LimitBytes = n
+		} else {
+			limits.Memory.Unlimited = true
+		}
+	}
+	if data, ok := read(memory, "memory.usage_in_bytes"); ok {
+		limits.Memory.UsageBytes = parseCgroupInt(data)
+	}
+	return limits
+}
+
+// setQuota records a CPU quota, where a nil or negative quota (v2's "max"
+// or v1's -1) means none.
+func (l *cgroupCPULimits) setQuota(quota, period *int64) {
+	if quota == nil || *quota < 0 || period == nil || *period <= 0 {
+		l.Unlimited = true
+		return
+	}
+	cores := float64(*quota) / float64(*period)
+	l.QuotaMicros, l.PeriodMicros, l.Cores = quota, period, &cores
+}
+
+// parseCgroupInt parses a cgroup value, returning nil for "max" or
+// anything else that is not an integer.
+func parseCgroupInt(s string) *int64 {
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &n
+}
+
+// parseCgroupStat parses the "key value" lines of files such as cpu.stat.
+func parseCgroupStat(data string) map[string]*int64 {
+	stat := map[string]*int64{}
+	for _, line := range strings.Split(data, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			if n := parseCgroupInt(fields[1]); n != nil {
+				stat[fields[0]] = n
+			}
+		}
+	}
+	return stat
+}
+
+// cgroupLimitsHandler serves /limits/cgroup: the CPU quota and memory
+// limit of the container, and its current memory usage and CPU
+// throttling, from the cgroup filesystem. Values whose files are missing
+// are left out and the files listed under missing.
+func cgroupLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <cgroupLimitsHandler>", getOnelineInfo(r))
+
+	limits, err := getCgroupLimits()
+	if err == errUnsupportedPlatform {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+	if err != nil {
+		handlerError(r, errKindProcRead, "getCgroupLimits()", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, limits)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupDir returns a cgroupFiles reading from the directory of path under
+// base, or from base itself when the file is not there: inside a container
+// the path of the process's cgroup is often not mounted, and base is its
+// cgroup already.
+func cgroupDir(base, path string) cgroupFiles {
+	return func(name string) (string, bool) {
+		for _, dir := range []string{filepath.Join(base, path), base} {
+			if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err == nil {
+				return string(data), true
+			}
+		}
+		return "", false
+	}
+}
+
+func getCgroupLimits() (cgroupLimits, error) {
+	info, err := getCgroups()
+	if err != nil {
+		return cgroupLimits{}, err
+	}
+	if info.Version == "v2" {
+		var path string
+		for _, cg := range info.Cgroups {
+			if cg.HierarchyID == 0 {
+				path = cg.Path
+			}
+		}
+		files := cgroupDir(cgroupRoot, path)
+		return readCgroupLimits("v2", files, files), nil
+	}
+	// v1 and hybrid: the controllers are on their own hierarchies.
+	paths := map[string]string{}
+	for _, cg := range info.Cgroups {
+		for _, controller := range cg.Controllers {
+			paths[controller] = cg.Path
+		}
+	}
+	return readCgroupLimits("v1",
+		cgroupDir(filepath.Join(cgroupRoot, "cpu"), paths["cpu"]),
+		cgroupDir(filepath.Join(cgroupRoot, "memory"), paths["memory"])), nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getCgroupLimits() (cgroupLimits, error) {
+	return cgroupLimits{}, errUnsupportedPlatform
+}
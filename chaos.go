@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosRand is the global chaos RNG, seeded from CHAOS_SEED at startup.
+var chaosRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// chaosSeed is CHAOS_SEED as read at startup, which requestChaosRand
+// mixes in. A reload does not change it, so outcomes stay reproducible.
+var chaosSeed int64
+
+// seedChaos reseeds the global chaos RNG and records seed for
+// requestChaosRand. A zero seed keeps the time-based seed.
+func seedChaos(seed int64) {
+	chaosSeed = seed
+	if seed == 0 {
+		return
+	}
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	chaosRand.Seed(seed)
+}
+
+// pathDelay returns the PathDelays entry that best matches path: an exact
+// match, or else the longest entry ending in "/" that prefixes path.
+func pathDelay(c *Config, path string) (time.Duration, bool) {
+	if d, ok := c.PathDelays[path]; ok {
+		return d, true
+	}
+	best := ""
+	for p := range c.PathDelays {
+		if strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) && len(p) > len(best) {
+			best = p
+		}
+	}
+	if best == "" {
+		return 0, false
+	}
+	return c.PathDelays[best], true
+}
+
+// chaosOutcome returns the delay to inject and whether to fail, drawing
+// both from rng. A matching PathDelays entry takes the place of the
+// random ChaosDelay.
+func chaosOutcome(c *Config, path string, rng *rand.Rand) (time.Duration, bool) {
+	delay, ok := pathDelay(c, path)
+	if !ok && c.ChaosDelay > 0 {
+		delay = time.Duration(rng.Int63n(int64(c.ChaosDelay) + 1))
+	}
+	return delay, rng.Float64() < c.ChaosFailRate
+}
+
+// requestChaosRand returns an RNG derived from the X-Chaos-Seed header and
+// the startup CHAOS_SEED, so that the same pair always yields the same
+// outcome, or nil if the header is absent.
+func requestChaosRand(r *http.Request) *rand.Rand {
+	seed := r.Header.Get("X-Chaos-Seed")
+	if seed == "" {
+		return nil
+	}
+	h := fnv.New64a()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(chaosSeed))
+	h.Write(b[:])
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// withChaos injects a random delay of up to ChaosDelay, or the matching
+// PathDelays entry, and fails a ChaosFailRate fraction of requests with
+// 503.
+func withChaos(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if c.ChaosDelay <= 0 && c.ChaosFailRate <= 0 && len(c.PathDelays) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var delay time.Duration
+		var fail bool
+		if rng := requestChaosRand(r); rng != nil {
+			delay, fail = chaosOutcome(c, r.URL.Path, rng)
+		} else {
+			chaosRand.Lock()
+			delay, fail = chaosOutcome(c, r.URL.Path, chaosRand.Rand)
+			chaosRand.Unlock()
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				observeCancellation(r.Context(), r)
+				return
+			}
+		}
+		if fail {
+			logFromCtx(r.Context()).Printf("chaos: failing request after %s", delay)
+			http.Error(w, "chaos: injected failure", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
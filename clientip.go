@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Sources reported by getClientIP.
+const (
+	clientIPRemoteAddr    = "remote_addr"
+	clientIPForwarded     = "forwarded"
+	clientIPXRealIP       = "x-real-ip"
+	clientIPXForwardedFor = "x-forwarded-for"
+)
+
+// forwardedElement is one hop of an RFC 7239 Forwarded header.
+type forwardedElement struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+// parseForwarded parses the Forwarded header values into their elements,
+// nearest-to-client first. Malformed pairs are skipped rather than
+// failing the whole header.
+func parseForwarded(values []string) []forwardedElement {
+	var elems []forwardedElement
+	for _, v := range values {
+		for _, raw := range strings.Split(v, ",") {
+			var e forwardedElement
+			for _, pair := range strings.Split(raw, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					continue
+				}
+				val := strings.TrimSpace(kv[1])
+				if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+					val = val[1 : len(val)-1]
+				}
+				switch strings.ToLower(kv[0]) {
+				case "for":
+					e.For = val
+				case "proto":
+					e.Proto = strings.ToLower(val)
+				case "host":
+					e.Host = val
+				}
+			}
+			if e != (forwardedElement{}) {
+				elems = append(elems, e)
+			}
+		}
+	}
+	return elems
+}
+
+// forwardedNodeIP extracts the IP from a Forwarded "for" node such as
+// "192.0.2.60", "192.0.2.60:4711" or "[2001:db8::1]:4711". Obfuscated and
+// "unknown" nodes yield "".
+func forwardedNodeIP(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.Trim(node, "[]")
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// getForwarded returns the client-most Forwarded element when TrustProxy
+// is set and the header is present.
+func getForwarded(r *http.Request) (forwardedElement, bool) {
+	if !currentConfig().TrustProxy {
+		return forwardedElement{}, false
+	}
+	elems := parseForwarded(r.Header.Values("Forwarded"))
+	if len(elems) == 0 {
+		return forwardedElement{}, false
+	}
+	return elems[0], true
+}
+
+// forwardedForHops returns the X-Forwarded-For chain, client first,
+// across all X-Forwarded-For headers, with surrounding whitespace trimmed
+// and empty entries dropped.
+func forwardedForHops(r *http.Request) []string {
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// getClientIP returns the client's IP address and the source it was taken
+// from. Forwarding headers are only consulted when TrustProxy is set. The
+// standard Forwarded header wins, then X-Real-IP, then the first
+// X-Forwarded-For entry: X-Real-IP is set by the nearest proxy while
+// X-Forwarded-For may carry client-supplied hops. Otherwise the
+// connection's remote address is used.
+func getClientIP(r *http.Request) (ip, source string) {
+	if fwd, ok := getForwarded(r); ok {
+		if ip := forwardedNodeIP(fwd.For); ip != "" {
+			return ip, clientIPForwarded
+		}
+	}
+	if currentConfig().TrustProxy {
+		if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); v != "" && net.ParseIP(v) != nil {
+			return v, clientIPXRealIP
+		}
+		if hops := forwardedForHops(r); len(hops) > 0 && net.ParseIP(hops[0]) != nil {
+			return hops[0], clientIPXForwardedFor
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr, clientIPRemoteAddr
+	}
+	return host, clientIPRemoteAddr
+}
+
+// getScheme returns the scheme the client used, "http" or "https". With
+// TrustProxy set, a proxy that terminated TLS can say so in the Forwarded
+// proto or X-Forwarded-Proto header; otherwise it is https only when the
+// connection to the app is TLS.
+func getScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto, ok := forwardedProto(r); ok {
+		return proto
+	}
+	return scheme
+}
+
+// forwardedProto returns the scheme a trusted proxy reports in the
+// Forwarded proto or X-Forwarded-Proto header. It reports false when
+// TrustProxy is unset or neither header names http or https.
+func forwardedProto(r *http.Request) (string, bool) {
+	if !currentConfig().TrustProxy {
+		return "", false
+	}
+	proto := ""
+	if fwd, ok := getForwarded(r); ok {
+		proto = fwd.Proto
+	}
+	if proto == "" {
+		proto = strings.ToLower(strings.TrimSpace(strings.SplitN(r.Header.Get("X-Forwarded-Proto"), ",", 2)[0]))
+	}
+	if proto == "http" || proto == "https" {
+		return proto, true
+	}
+	return "", false
+}
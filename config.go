@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Log levels and formats accepted by LOG_LEVEL and LOG_FORMAT.
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Trailing slash policies accepted by TRAILING_SLASH.
+const (
+	trailingSlashRedirect   = "redirect"
+	trailingSlashEquivalent = "equivalent"
+	trailingSlashOff        = "off"
+)
+
+// Answers for unmatched paths under StrictRoot, accepted by
+// STRICT_ROOT_FALLBACK.
+const (
+	rootFallbackNotFound = "not_found"
+	rootFallbackHint     = "hint"
+	rootFallbackRedirect = "redirect"
+)
+
+// Formats of the X-Instance-Start header accepted by
+// INSTANCE_START_HEADER.
+const (
+	instanceStartOff     = "off"
+	instanceStartRFC3339 = "rfc3339"
+	instanceStartUnix    = "unix"
+)
+
+// Field name styles accepted by JSON_FIELD_CASE.
+const (
+	jsonCaseSnake = "snake"
+	jsonCaseCamel = "camel"
+)
+
+// Policies for requests without a Host header accepted by MISSING_HOST.
+const (
+	missingHostAllow  = "allow"
+	missingHostReject = "reject"
+)
+
+// Response modes accepted by RESPONSE_MODE.
+const (
+	responseModeBuffered  = "buffered"
+	responseModeStreaming = "streaming"
+)
+
+// Config holds the settings read from the environment and, when
+// CONFIG_FILE is set, from that file. Fields may change on SIGHUP unless
+// documented as read at startup only.
+type Config struct {
+	// MaxURLLength is the longest request URL accepted before replying
+	// 414 Request-URI Too Long.
+	MaxURLLength int
+	// AllowedHosts lists the Host header values accepted. Entries of the
+	// form "*.example.com" match any subdomain. Empty allows every host.
+	AllowedHosts []string
+	// AppColor is a deployment variant label (e.g. "blue") reported by
+	// /color and the X-App-Color header. Empty disables the header.
+	AppColor string
+	// ResponseTimeHeader adds X-Response-Time-Ms to every response.
+	ResponseTimeHeader bool
+	// LogLevel is logLevelInfo or logLevelDebug. Debug adds detail such
+	// as the response Content-Type to the access log.
+	LogLevel string
+	// LogFormat selects plain text or JSON access log lines.
+	LogFormat string
+	// DisabledRoutes lists route patterns (e.g. "/ps") that answer 404
+	// instead of being served. Read at startup only.
+	DisabledRoutes []string
+	// IncludeLinkLocal lets the reported local address fall back to an
+	// IPv6 link-local address when no other address is available.
+	IncludeLinkLocal bool
+	// ShutdownGracePeriod bounds how long each shutdown hook, including
+	// draining in-flight requests, may take.
+	ShutdownGracePeriod time.Duration
+	// TrustProxy allows client addresses to be taken from X-Real-IP and
+	// X-Forwarded-For. Only enable it behind a proxy that sets them.
+	TrustProxy bool
+	// AdminToken is the bearer token required by privileged endpoints.
+	// They refuse every request while it is empty.
+	AdminToken string
+	// AuditLog is where token checks are logged: "stdout" (the default),
+	// "stderr" or a file path. Read at startup only.
+	AuditLog string
+	// ProcReader enables /proc/<pid>/<file>.
+	ProcReader bool
+	// DebugEndpoints enables the /debug/ endpoints such as /debug/gc and
+	// /debug/metrics/check.
+	DebugEndpoints bool
+	// DiagTimeout is the total time budget for /diag. Sections still
+	// running when it expires are reported as timed out.
+	DiagTimeout time.Duration
+	// TLSCertFile and TLSKeyFile enable HTTPS on the app port when both
+	// are set. Read at startup only.
+	TLSCertFile string
+	TLSKeyFile  string
+	// StrictRoot serves hello only for the exact path "/" and answers 404
+	// for other unmatched paths. When false, "/" catches every unmatched
+	// path.
+	StrictRoot bool
+	// TrailingSlash decides what "/version/" and the like do for fixed
+	// routes: redirect to the form without the slash, be served the same,
+	// or, when off, fall through to "/". Read at startup only.
+	TrailingSlash string
+	// MetricsToken requires "Authorization: Bearer <token>" on the metrics
+	// port. MetricsUser and MetricsPassword require basic auth instead or
+	// in addition. The metrics port is open when all are empty.
+	MetricsToken    string
+	MetricsUser     string
+	MetricsPassword string
+	// MetricsOpenMetrics lets scrapers negotiate the OpenMetrics format via
+	// the Accept header; when false the text format is always served. Read
+	// at startup only.
+	MetricsOpenMetrics bool
+	// ProfileDir enables periodic CPU and heap profiles written to this
+	// directory every ProfileInterval, keeping the newest ProfileKeep of
+	// each kind. Read at startup only.
+	ProfileDir      string
+	ProfileInterval time.Duration
+	ProfileKeep     int
+	// StartupProfile, if set, is the file a CPU profile of the first
+	// StartupProfileDuration after boot is written to. Read at startup only.
+	StartupProfile         string
+	StartupProfileDuration time.Duration
+	// ReapZombies reaps orphaned child processes when running as PID 1.
+	// Read at startup only.
+	ReapZombies bool
+	// PSCacheTTL is how long a process enumeration is reused by /ps and
+	// the other process views. Zero disables caching, but concurrent
+	// requests still share one enumeration.
+	PSCacheTTL time.Duration
+	// PSMaxConcurrent limits how many callers may be waiting on a fresh
+	// process enumeration at once. Read at startup only.
+	PSMaxConcurrent int
+	// ResponseMode selects whether the diagnostic endpoints buffer their
+	// response, so it carries a Content-Length and a late error can still
+	// become a clean 500, or stream it with chunked encoding.
+	ResponseMode string
+	// UpdateCheckURL is an https URL serving the latest version string for
+	// /selfupdate/check. Empty disables the endpoint.
+	UpdateCheckURL string
+	// UpdateCheckTimeout bounds the request to UpdateCheckURL.
+	UpdateCheckTimeout time.Duration
+	// ChaosDelay is the upper bound of a random delay injected before
+	// each request. Zero disables it.
+	ChaosDelay time.Duration
+	// ChaosFailRate is the fraction of requests, from 0 to 1, answered
+	// with 503.
+	ChaosFailRate float64
+	// ChaosSeed seeds the global chaos RNG at startup; zero uses a
+	// time-based seed. It is also mixed into every X-Chaos-Seed.
+	ChaosSeed int64
+	// PathDelays maps paths to a fixed delay that replaces ChaosDelay for
+	// matching requests, from DELAY_<path> entries such as DELAY_/ps=2s.
+	// A path ending in "/" matches every path below it.
+	PathDelays map[string]time.Duration
+	// WarmupRequests is how many in-process requests are sent to "/" in
+	// the background as the app server starts; /readyz fails until they
+	// are done. Read at startup only.
+	WarmupRequests int
+	// TopPaths is how many routes /toppaths lists when n is not given.
+	TopPaths int
+	// PropagateHeaders lists request headers, in canonical form, that are
+	// copied into the response. Hop-by-hop headers are not allowed.
+	PropagateHeaders []string
+	// MaxConcurrentRequests caps how many requests the app server handles
+	// at once; zero means no limit. Read at startup only.
+	MaxConcurrentRequests int
+	// RequestQueueTimeout is how long a request over the limit waits for a
+	// slot before being rejected with 503.
+	RequestQueueTimeout time.Duration
+	// BodyFiles maps request paths to files served in place of the real
+	// handler, from BODY_FILE_<path> entries such as
+	// BODY_FILE_/version=/etc/app/version.txt.
+	BodyFiles map[string]string
+	// HostGreetings maps lower-cased host names to the greeting shown to
+	// requests for them, from HOST_GREETING_<host> entries.
+	HostGreetings map[string]string
+	// MaxStreams caps concurrent long-lived streaming responses such as
+	// /events; more are rejected with 503.
+	MaxStreams int
+	// UpgradeRejectStatus is the status, 400 or 426, answered to protocol
+	// upgrade requests on routes that do not support them.
+	UpgradeRejectStatus int
+	// LogQuery adds the query string, with sensitive parameters redacted,
+	// to the URI in access log lines; otherwise only the path is logged.
+	LogQuery bool
+	// MaxOutbound is the number of workers running outbound probes such as
+	// /ping/tcp. Requests wait for one within their probe timeout and are
+	// rejected with 503 past it. Read at startup only.
+	MaxOutbound int
+	// FetchConnectTimeout, FetchTLSTimeout and FetchTimeout bound the dial,
+	// the TLS handshake and the whole of a /fetch request; at most
+	// FetchMaxBody bytes of the response are read.
+	FetchConnectTimeout time.Duration
+	FetchTLSTimeout     time.Duration
+	FetchTimeout        time.Duration
+	FetchMaxBody        int
+	// ReadinessInterval is how often the background check behind /readyz
+	// runs; ReadinessFailureThreshold consecutive failures make the
+	// instance unready. Read at startup only.
+	ReadinessInterval         time.Duration
+	ReadinessFailureThreshold int
+	// NotFoundRateLimit caps, per second across all clients, the 404s
+	// answered for unmatched paths; more get 429. Zero disables the limit.
+	NotFoundRateLimit float64
+	// RouteHeader adds an X-Route header naming the matched route to
+	// every routed response.
+	RouteHeader bool
+	// WarmupReject answers app routes, other than the probes, with 503
+	// while warmup runs instead of serving them.
+	WarmupReject bool
+	// DrainDelay is how long shutdown waits, with /readyz failing, before
+	// the app server stops accepting connections. It must be shorter than
+	// ShutdownGracePeriod. Read at startup only.
+	DrainDelay time.Duration
+	// Greeting is shown by "/" to hosts without a HostGreetings entry,
+	// unless GreetingFile is set and readable.
+	Greeting string
+	// GreetingFile, such as a mounted ConfigMap key, is polled for changes
+	// and its contents used as the greeting. Read at startup only.
+	GreetingFile string
+	// Gzip compresses responses for clients that send
+	// "Accept-Encoding: gzip".
+	Gzip bool
+	// MaxRenderedHeaders caps how many request headers "/" and /reflect/
+	// echo back; the rest are summarized as a count.
+	MaxRenderedHeaders int
+	// MetricsCORSOrigins are the origins allowed to read the metrics
+	// endpoint from a browser; "*" allows any.
+	MetricsCORSOrigins []string
+	// GzipMinBytes is the smallest response body Gzip or Brotli
+	// compresses; smaller ones are buffered and sent as they are.
+	GzipMinBytes int
+	// TopMemInterval, when set, logs the TopMemCount processes with the
+	// largest RSS at that interval. Linux only. Read at startup only.
+	TopMemInterval time.Duration
+	TopMemCount    int
+	// StrictRootFallback is how StrictRoot answers unmatched paths: a
+	// plain 404, a 404 pointing at /routes, or a redirect to "/".
+	StrictRootFallback string
+	// AppPort and MetricsPort are the ports of the app and metrics
+	// servers. With MetricsOnAppPort set, or both ports the same, a single
+	// server on AppPort also serves /metrics. Read at startup only.
+	AppPort          int
+	MetricsPort      int
+	MetricsOnAppPort bool
+	// StartupDelay is slept before the listeners are bound, to simulate a
+	// slow start. Read at startup only.
+	StartupDelay time.Duration
+	// InstanceStartHeader adds the process start time to every response
+	// as X-Instance-Start, in RFC 3339 or Unix seconds, unless off.
+	InstanceStartHeader string
+	// ALPNHeader names the negotiated ALPN protocol of TLS requests in an
+	// X-ALPN response header.
+	ALPNHeader bool
+	// GatewayProbePort is the port /gateway?probe=true connects to on the
+	// gateway.
+	GatewayProbePort int
+	// JSONFieldCase is the style of the field names in JSON responses:
+	// snake_case, as declared, or camelCase.
+	JSONFieldCase string
+	// KubernetesEnv maps the fields of the kubernetes section of /diag to
+	// the environment variables they are read from, typically set with the
+	// Downward API.
+	KubernetesEnv map[string]string
+	// MaxStreamDuration is how long a streaming response such as /events
+	// may stay open before the server ends it.
+	MaxStreamDuration time.Duration
+	// GeoHeaders are looked for by /geo on top of the common CDN
+	// geolocation headers.
+	GeoHeaders []string
+	// TCPKeepAlive is the TCP keep-alive period of connections accepted by
+	// the app server: 0 keeps Go's default of 15s and a negative value
+	// turns keep-alives off. Read at startup only.
+	TCPKeepAlive time.Duration
+	// VersionModule adds the main module's path and version from the
+	// build info to /version, after the app version.
+	VersionModule bool
+	// FetchAllowedHosts lists the hosts /fetch may reach, as patterns like
+	// those of AllowedHosts. Empty allows every host.
+	FetchAllowedHosts []string
+	// FetchAllowPrivate lets /fetch connect to loopback, private,
+	// link-local and other internal addresses, which include cloud
+	// metadata services.
+	FetchAllowPrivate bool
+	// Brotli compresses responses for clients that send
+	// "Accept-Encoding: br", in preference to gzip.
+	Brotli bool
+	// SlowRequest, when set, is the duration past which a request is
+	// logged as slow and counted in http_slow_requests_total.
+	SlowRequest time.Duration
+	// MissingHost says what to do with requests that have no Host header,
+	// as HTTP/1.0 ones may: reject them with 400, or allow them whatever
+	// AllowedHosts says and show the host as "<none>".
+	MissingHost string
+	// AllowTrace lets TRACE requests through to the routes, which
+	// otherwise answer them with 405.
+	AllowTrace bool
+	// Endpoints enables (true) or disables (false) routes by name, as
+	// listed by /routes, on top of DisabledRoutes. Read at startup only.
+	Endpoints map[string]bool
+	// HelloRequestCount adds the http_requests_total count to the "/"
+	// response.
+	HelloRequestCount bool
+	// ForceHTTPS redirects requests that a trusted proxy forwarded from
+	// plain http to https. It requires TrustProxy.
+	ForceHTTPS bool
+	// QueryMaxLength and QueryMaxParams bound the query string of the
+	// routes that take parameters, checked by checkQuery.
+	// RouteQueryMaxLength and RouteQueryMaxParams override them by route
+	// name, keyed by queryLimitKey.
+	QueryMaxLength      int
+	QueryMaxParams      int
+	RouteQueryMaxLength map[string]int
+	RouteQueryMaxParams map[string]int
+	// metricsPortSet records that METRICS_PORT was given explicitly.
+	metricsPortSet bool
+	// settings records where each setting read by loadConfig came from,
+	// keyed by name, for /config.
+	settings map[string]*setting
+}
+
+// metricsOnAppPort reports whether /metrics is served by the app server
+// rather than a server of its own.
+func (c *Config) metricsOnAppPort() bool {
+	return c.MetricsOnAppPort || c.AppPort == c.MetricsPort
+}
+
+func (c *Config) tlsEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// config holds the *Config in effect. It is replaced atomically on reload,
+// so readers should call currentConfig once per request.
+var config atomic.Value
+
+func init() {
+	config.Store(defaultConfig())
+}
+
+func currentConfig() *Config {
+	return config.Load().(*Config)
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		MaxURLLength: 8192,
+		LogLevel:     logLevelInfo,
+		LogFormat:    logFormatText,
+
+		ShutdownGracePeriod: 10 * time.Second,
+		DiagTimeout:         2 * time.Second,
+		StrictRoot:          true,
+		TrailingSlash:       trailingSlashRedirect,
+		MetricsOpenMetrics:  true,
+		ProfileInterval:     5 * time.Minute,
+		ProfileKeep:         12,
+		PSCacheTTL:          time.Second,
+		PSMaxConcurrent:     2,
+		ResponseMode:        responseModeBuffered,
+		UpdateCheckTimeout:  5 * time.Second,
+		TopPaths:            10,
+		RequestQueueTimeout: time.Second,
+		MaxStreams:          100,
+		UpgradeRejectStatus: http.StatusBadRequest,
+		MaxOutbound:         8,
+		Greeting:            "Hello, World!",
+		MaxRenderedHeaders:  200,
+		GzipMinBytes:        1024,
+		TopMemCount:         5,
+		StrictRootFallback:  rootFallbackNotFound,
+		AppPort:             8080,
+		InstanceStartHeader: instanceStartOff,
+		GatewayProbePort:    53,
+		JSONFieldCase:       jsonCaseSnake,
+		MissingHost:         missingHostAllow,
+		LogQuery:            true,
+		QueryMaxLength:      defaultQueryMaxLength,
+		QueryMaxParams:      defaultQueryMaxParams,
+		RouteQueryMaxLength: map[string]int{"base64": base64QueryMaxLength},
+		MaxStreamDuration:   10 * time.Minute,
+		KubernetesEnv: map[string]string{
+			"pod_name":  "K8S_POD_NAME",
+			"namespace": "K8S_NAMESPACE",
+			"node_name": "K8S_NODE_NAME",
+			"pod_ip":    "K8S_POD_IP",
+		},
+		MetricsPort:         9090,
+		FetchConnectTimeout: 5 * time.Second,
+		FetchTLSTimeout:     5 * time.Second,
+		FetchTimeout:        10 * time.Second,
+		FetchMaxBody:        1 << 20,
+
+		StartupProfileDuration:    30 * time.Second,
+		ReadinessInterval:         10 * time.Second,
+		ReadinessFailureThreshold: 3,
+	}
+}
+
+// loadConfig builds a Config from the defaults overridden by CONFIG_FILE
+// and environment variables, and validates it.
+func loadConfig() (*Config, error) {
+	src, err := newConfigSource(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	if c.MaxURLLength, err = src.getInt("MAX_URL_LENGTH", c.MaxURLLength); err != nil {
+		return nil, err
+	}
+	if c.MaxURLLength <= 0 {
+		return nil, fmt.Errorf("MAX_URL_LENGTH must be positive, got %d", c.MaxURLLength)
+	}
+	c.AllowedHosts = src.getList("ALLOWED_HOSTS", c.AllowedHosts)
+	c.AppColor = src.get("APP_COLOR")
+	if c.ResponseTimeHeader, err = src.getBool("RESPONSE_TIME_HEADER", c.ResponseTimeHeader); err != nil {
+		return nil, err
+	}
+	if c.LogLevel, err = src.getEnum("LOG_LEVEL", c.LogLevel, logLevelInfo, logLevelDebug); err != nil {
+		return nil, err
+	}
+	if c.LogFormat, err = src.getEnum("LOG_FORMAT", c.LogFormat, logFormatText, logFormatJSON); err != nil {
+		return nil, err
+	}
+	c.DisabledRoutes = src.getList("DISABLED_ROUTES", c.DisabledRoutes)
+	if c.IncludeLinkLocal, err = src.getBool("INCLUDE_LINK_LOCAL", c.IncludeLinkLocal); err != nil {
+		return nil, err
+	}
+	if c.ShutdownGracePeriod, err = src.getDuration("SHUTDOWN_GRACE_PERIOD", c.ShutdownGracePeriod); err != nil {
+		return nil, err
+	}
+	if c.TrustProxy, err = src.getBool("TRUST_PROXY", c.TrustProxy); err != nil {
+		return nil, err
+	}
+	c.AdminToken = src.get("ADMIN_TOKEN")
+	c.AuditLog = src.get("AUDIT_LOG")
+	if c.ProcReader, err = src.getBool("ENABLE_PROC_READER", c.ProcReader); err != nil {
+		return nil, err
+	}
+	if c.DebugEndpoints, err = src.getBool("ENABLE_DEBUG_ENDPOINTS", c.DebugEndpoints); err != nil {
+		return nil, err
+	}
+	if c.DiagTimeout, err = src.getDuration("DIAG_TIMEOUT", c.DiagTimeout); err != nil {
+		return nil, err
+	}
+	if c.DiagTimeout <= 0 {
+		return nil, fmt.Errorf("DIAG_TIMEOUT must be positive, got %s", c.DiagTimeout)
+	}
+	c.TLSCertFile = src.get("TLS_CERT_FILE")
+	c.TLSKeyFile = src.get("TLS_KEY_FILE")
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.StrictRoot, err = src.getBool("STRICT_ROOT", c.StrictRoot); err != nil {
+		return nil, err
+	}
+	c.MetricsToken = src.get("METRICS_TOKEN")
+	c.MetricsUser = src.get("METRICS_USER")
+	c.MetricsPassword = src.get("METRICS_PASSWORD")
+	if c.MetricsPassword != "" && c.MetricsUser == "" {
+		return nil, fmt.Errorf("METRICS_PASSWORD requires METRICS_USER")
+	}
+	if c.MetricsOpenMetrics, err = src.getBool("METRICS_OPENMETRICS", c.MetricsOpenMetrics); err != nil {
+		return nil, err
+	}
+	c.ProfileDir = src.get("PROFILE_DIR")
+	if c.ProfileInterval, err = src.getDuration("PROFILE_INTERVAL", c.ProfileInterval); err != nil {
+		return nil, err
+	}
+	if c.ProfileInterval < 2*profileCPUDuration {
+		return nil, fmt.Errorf("PROFILE_INTERVAL must be at least %s, got %s", 2*profileCPUDuration, c.ProfileInterval)
+	}
+	if c.ProfileKeep, err = src.getInt("PROFILE_KEEP", c.ProfileKeep); err != nil {
+		return nil, err
+	}
+	if c.ProfileKeep <= 0 {
+		return nil, fmt.Errorf("PROFILE_KEEP must be positive, got %d", c.ProfileKeep)
+	}
+	c.StartupProfile = src.get("STARTUP_PROFILE")
+	if c.StartupProfileDuration, err = src.getDuration("STARTUP_PROFILE_DURATION", c.StartupProfileDuration); err != nil {
+		return nil, err
+	}
+	if c.StartupProfileDuration <= 0 {
+		return nil, fmt.Errorf("STARTUP_PROFILE_DURATION must be positive, got %s", c.StartupProfileDuration)
+	}
+	if c.ReapZombies, err = src.getBool("REAP_ZOMBIES", c.ReapZombies); err != nil {
+		return nil, err
+	}
+	if c.PSCacheTTL, err = src.getDuration("PS_CACHE_TTL", c.PSCacheTTL); err != nil {
+		return nil, err
+	}
+	if c.PSCacheTTL < 0 {
+		return nil, fmt.Errorf("PS_CACHE_TTL must not be negative, got %s", c.PSCacheTTL)
+	}
+	if c.ResponseMode, err = src.getEnum("RESPONSE_MODE", c.ResponseMode, responseModeBuffered, responseModeStreaming); err != nil {
+		return nil, err
+	}
+	c.UpdateCheckURL = src.get("UPDATE_CHECK_URL")
+	if c.UpdateCheckURL != "" {
+		u, err := url.Parse(c.UpdateCheckURL)
+		if err != nil {
+			return nil, fmt.Errorf("UPDATE_CHECK_URL: %v", err)
+		}
+		if u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("UPDATE_CHECK_URL must be an https URL, got %q", c.UpdateCheckURL)
+		}
+	}
+	if c.UpdateCheckTimeout, err = src.getDuration("UPDATE_CHECK_TIMEOUT", c.UpdateCheckTimeout); err != nil {
+		return nil, err
+	}
+	if c.UpdateCheckTimeout <= 0 {
+		return nil, fmt.Errorf("UPDATE_CHECK_TIMEOUT must be positive, got %s", c.UpdateCheckTimeout)
+	}
+	if c.ChaosDelay, err = src.getDuration("CHAOS_DELAY", c.ChaosDelay); err != nil {
+		return nil, err
+	}
+	if c.ChaosDelay < 0 {
+		return nil, fmt.Errorf("CHAOS_DELAY must not be negative, got %s", c.ChaosDelay)
+	}
+	if c.ChaosFailRate, err = src.getFloat("CHAOS_FAIL_RATE", c.ChaosFailRate); err != nil {
+		return nil, err
+	}
+	if c.ChaosFailRate < 0 || c.ChaosFailRate > 1 {
+		return nil, fmt.Errorf("CHAOS_FAIL_RATE must be between 0 and 1, got %g", c.ChaosFailRate)
+	}
+	for path, v := range src.getPrefixed("DELAY_") {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("DELAY_%s: %v", path, err)
+		}
+		if !strings.HasPrefix(path, "/") || d < 0 {
+			return nil, fmt.Errorf("DELAY_%s: want a path starting with / and a non-negative duration", path)
+		}
+		if c.PathDelays == nil {
+			c.PathDelays = map[string]time.Duration{}
+		}
+		c.PathDelays[path] = d
+	}
+	var seed int
+	if seed, err = src.getInt("CHAOS_SEED", int(c.ChaosSeed)); err != nil {
+		return nil, err
+	}
+	c.ChaosSeed = int64(seed)
+	if c.WarmupRequests, err = src.getInt("WARMUP_REQUESTS", c.WarmupRequests); err != nil {
+		return nil, err
+	}
+	if c.WarmupRequests < 0 {
+		return nil, fmt.Errorf("WARMUP_REQUESTS must not be negative, got %d", c.WarmupRequests)
+	}
+	if c.TopPaths, err = src.getInt("TOP_PATHS", c.TopPaths); err != nil {
+		return nil, err
+	}
+	if c.TopPaths <= 0 {
+		return nil, fmt.Errorf("TOP_PATHS must be positive, got %d", c.TopPaths)
+	}
+	for _, name := range src.getList("PROPAGATE_HEADERS", nil) {
+		name = http.CanonicalHeaderKey(name)
+		if hopByHopHeaders[name] {
+			return nil, fmt.Errorf("PROPAGATE_HEADERS: %s is a hop-by-hop header", name)
+		}
+		c.PropagateHeaders = append(c.PropagateHeaders, name)
+	}
+	if c.PSMaxConcurrent, err = src.getInt("PS_MAX_CONCURRENT", c.PSMaxConcurrent); err != nil {
+		return nil, err
+	}
+	if c.PSMaxConcurrent <= 0 {
+		return nil, fmt.Errorf("PS_MAX_CONCURRENT must be positive, got %d", c.PSMaxConcurrent)
+	}
+	if c.MaxConcurrentRequests, err = src.getInt("MAX_CONCURRENT_REQUESTS", c.MaxConcurrentRequests); err != nil {
+		return nil, err
+	}
+	if c.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT_REQUESTS must not be negative, got %d", c.MaxConcurrentRequests)
+	}
+	if c.RequestQueueTimeout, err = src.getDuration("REQUEST_QUEUE_TIMEOUT", c.RequestQueueTimeout); err != nil {
+		return nil, err
+	}
+	if c.RequestQueueTimeout < 0 {
+		return nil, fmt.Errorf("REQUEST_QUEUE_TIMEOUT must not be negative, got %s", c.RequestQueueTimeout)
+	}
+	for path, name := range src.getPrefixed("BODY_FILE_") {
+		if !strings.HasPrefix(path, "/") || name == "" {
+			return nil, fmt.Errorf("BODY_FILE_%s: want a path starting with / and a file name", path)
+		}
+		if c.BodyFiles == nil {
+			c.BodyFiles = map[string]string{}
+		}
+		c.BodyFiles[path] = name
+	}
+	for host, greeting := range src.getPrefixed("HOST_GREETING_") {
+		host = strings.ToLower(host)
+		if len(c.AllowedHosts) > 0 && !hostAllowed(host, c.AllowedHosts) {
+			return nil, fmt.Errorf("HOST_GREETING_%s: host is not in ALLOWED_HOSTS", host)
+		}
+		if c.HostGreetings == nil {
+			c.HostGreetings = map[string]string{}
+		}
+		c.HostGreetings[host] = greeting
+	}
+	if c.MaxStreams, err = src.getInt("MAX_STREAMS", c.MaxStreams); err != nil {
+		return nil, err
+	}
+	if c.MaxStreams <= 0 {
+		return nil, fmt.Errorf("MAX_STREAMS must be positive, got %d", c.MaxStreams)
+	}
+	if c.TrailingSlash, err = src.getEnum("TRAILING_SLASH", c.TrailingSlash, trailingSlashRedirect, trailingSlashEquivalent, trailingSlashOff); err != nil {
+		return nil, err
+	}
+	if c.UpgradeRejectStatus, err = src.getInt("UPGRADE_REJECT_STATUS", c.UpgradeRejectStatus); err != nil {
+		return nil, err
+	}
+	if c.UpgradeRejectStatus != http.StatusBadRequest && c.UpgradeRejectStatus != http.StatusUpgradeRequired {
+		return nil, fmt.Errorf("UPGRADE_REJECT_STATUS must be 400 or 426, got %d", c.UpgradeRejectStatus)
+	}
+	if c.LogQuery, err = src.getBool("LOG_QUERY", c.LogQuery); err != nil {
+		return nil, err
+	}
+	if c.MaxOutbound, err = src.getInt("MAX_OUTBOUND", c.MaxOutbound); err != nil {
+		return nil, err
+	}
+	if c.MaxOutbound <= 0 {
+		return nil, fmt.Errorf("MAX_OUTBOUND must be positive, got %d", c.MaxOutbound)
+	}
+	if c.FetchConnectTimeout, err = src.getDuration("FETCH_CONNECT_TIMEOUT", c.FetchConnectTimeout); err != nil {
+		return nil, err
+	}
+	if c.FetchTLSTimeout, err = src.getDuration("FETCH_TLS_TIMEOUT", c.FetchTLSTimeout); err != nil {
+		return nil, err
+	}
+	if c.FetchTimeout, err = src.getDuration("FETCH_TIMEOUT", c.FetchTimeout); err != nil {
+		return nil, err
+	}
+	if c.FetchMaxBody, err = src.getInt("FETCH_MAX_BODY", c.FetchMaxBody); err != nil {
+		return nil, err
+	}
+	if err := validateFetchLimits(c); err != nil {
+		return nil, err
+	}
+	if c.ReadinessInterval, err = src.getDuration("READINESS_INTERVAL", c.ReadinessInterval); err != nil {
+		return nil, err
+	}
+	if c.ReadinessInterval <= 0 {
+		return nil, fmt.Errorf("READINESS_INTERVAL must be positive, got %s", c.ReadinessInterval)
+	}
+	if c.ReadinessFailureThreshold, err = src.getInt("READINESS_FAILURE_THRESHOLD", c.ReadinessFailureThreshold); err != nil {
+		return nil, err
+	}
+	if c.ReadinessFailureThreshold <= 0 {
+		return nil, fmt.Errorf("READINESS_FAILURE_THRESHOLD must be positive, got %d", c.ReadinessFailureThreshold)
+	}
+	if c.NotFoundRateLimit, err = src.getFloat("NOT_FOUND_RATE_LIMIT", c.NotFoundRateLimit); err != nil {
+		return nil, err
+	}
+	if c.NotFoundRateLimit < 0 {
+		return nil, fmt.Errorf("NOT_FOUND_RATE_LIMIT must not be negative, got %g", c.NotFoundRateLimit)
+	}
+	if c.RouteHeader, err = src.getBool("ROUTE_HEADER", c.RouteHeader); err != nil {
+		return nil, err
+	}
+	if c.WarmupReject, err = src.getBool("WARMUP_REJECT", c.WarmupReject); err != nil {
+		return nil, err
+	}
+	if c.DrainDelay, err = src.getDuration("DRAIN_DELAY", c.DrainDelay); err != nil {
+		return nil, err
+	}
+	if v := src.get("GREETING"); v != "" {
+		c.Greeting = v
+	} else {
+		src.defaulted("GREETING", c.Greeting)
+	}
+	c.GreetingFile = src.get("GREETING_FILE")
+	if c.Gzip, err = src.getBool("GZIP", c.Gzip); err != nil {
+		return nil, err
+	}
+	if c.MaxRenderedHeaders, err = src.getInt("MAX_RENDERED_HEADERS", c.MaxRenderedHeaders); err != nil {
+		return nil, err
+	}
+	if c.MaxRenderedHeaders <= 0 {
+		return nil, fmt.Errorf("MAX_RENDERED_HEADERS must be positive, got %d", c.MaxRenderedHeaders)
+	}
+	c.MetricsCORSOrigins = src.getList("METRICS_CORS_ORIGINS", c.MetricsCORSOrigins)
+	if c.GzipMinBytes, err = src.getInt("GZIP_MIN_BYTES", c.GzipMinBytes); err != nil {
+		return nil, err
+	}
+	if c.GzipMinBytes < 0 {
+		return nil, fmt.Errorf("GZIP_MIN_BYTES must not be negative, got %d", c.GzipMinBytes)
+	}
+	if c.TopMemInterval, err = src.getDuration("TOP_MEM_INTERVAL", c.TopMemInterval); err != nil {
+		return nil, err
+	}
+	if c.TopMemInterval < 0 {
+		return nil, fmt.Errorf("TOP_MEM_INTERVAL must not be negative, got %s", c.TopMemInterval)
+	}
+	if c.TopMemCount, err = src.getInt("TOP_MEM_COUNT", c.TopMemCount); err != nil {
+		return nil, err
+	}
+	if c.TopMemCount < 1 || c.TopMemCount > maxTopMemCount {
+		return nil, fmt.Errorf("TOP_MEM_COUNT must be between 1 and %d, got %d", maxTopMemCount, c.TopMemCount)
+	}
+	if c.StrictRootFallback, err = src.getEnum("STRICT_ROOT_FALLBACK", c.StrictRootFallback, rootFallbackNotFound, rootFallbackHint, rootFallbackRedirect); err != nil {
+		return nil, err
+	}
+	for _, p := range []struct {
+		name string
+		port *int
+	}{{"APP_PORT", &c.AppPort}, {"METRICS_PORT", &c.MetricsPort}} {
+		if *p.port, err = src.getInt(p.name, *p.port); err != nil {
+			return nil, err
+		}
+		if *p.port < 1 || *p.port > 65535 {
+			return nil, fmt.Errorf("%s must be between 1 and 65535, got %d", p.name, *p.port)
+		}
+	}
+	c.metricsPortSet = src.get("METRICS_PORT") != ""
+	if c.MetricsOnAppPort, err = src.getBool("METRICS_ON_APP_PORT", c.MetricsOnAppPort); err != nil {
+		return nil, err
+	}
+	if c.StartupDelay, err = src.getDuration("STARTUP_DELAY", c.StartupDelay); err != nil {
+		return nil, err
+	}
+	if c.StartupDelay < 0 {
+		return nil, fmt.Errorf("STARTUP_DELAY must not be negative, got %s", c.StartupDelay)
+	}
+	if c.InstanceStartHeader, err = src.getEnum("INSTANCE_START_HEADER", c.InstanceStartHeader, instanceStartOff, instanceStartRFC3339, instanceStartUnix); err != nil {
+		return nil, err
+	}
+	if c.ALPNHeader, err = src.getBool("ALPN_HEADER", c.ALPNHeader); err != nil {
+		return nil, err
+	}
+	if c.GatewayProbePort, err = src.getInt("GATEWAY_PROBE_PORT", c.GatewayProbePort); err != nil {
+		return nil, err
+	}
+	if c.GatewayProbePort < 1 || c.GatewayProbePort > 65535 {
+		return nil, fmt.Errorf("GATEWAY_PROBE_PORT must be between 1 and 65535, got %d", c.GatewayProbePort)
+	}
+	if c.JSONFieldCase, err = src.getEnum("JSON_FIELD_CASE", c.JSONFieldCase, jsonCaseSnake, jsonCaseCamel); err != nil {
+		return nil, err
+	}
+	if pairs := src.getList("KUBERNETES_ENV", nil); pairs != nil {
+		c.KubernetesEnv = make(map[string]string, len(pairs))
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("KUBERNETES_ENV: %q is not field=VARIABLE", pair)
+			}
+			c.KubernetesEnv[kv[0]] = kv[1]
+		}
+	}
+	if c.MaxStreamDuration, err = src.getDuration("MAX_STREAM_DURATION", c.MaxStreamDuration); err != nil {
+		return nil, err
+	}
+	if c.MaxStreamDuration <= 0 {
+		return nil, fmt.Errorf("MAX_STREAM_DURATION must be positive, got %s", c.MaxStreamDuration)
+	}
+	c.GeoHeaders = src.getList("GEO_HEADERS", c.GeoHeaders)
+	if c.TCPKeepAlive, err = src.getDuration("TCP_KEEPALIVE_PERIOD", c.TCPKeepAlive); err != nil {
+		return nil, err
+	}
+	if c.VersionModule, err = src.getBool("VERSION_MODULE", c.VersionModule); err != nil {
+		return nil, err
+	}
+	c.FetchAllowedHosts = src.getList("FETCH_ALLOWED_HOSTS", c.FetchAllowedHosts)
+	if c.FetchAllowPrivate, err = src.getBool("FETCH_ALLOW_PRIVATE", c.FetchAllowPrivate); err != nil {
+		return nil, err
+	}
+	if c.Brotli, err = src.getBool("BROTLI", c.Brotli); err != nil {
+		return nil, err
+	}
+	slowMs, err := src.getInt("SLOW_REQUEST_MS", int(c.SlowRequest/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if slowMs < 0 {
+		return nil, fmt.Errorf("SLOW_REQUEST_MS must not be negative, got %d", slowMs)
+	}
+	c.SlowRequest = time.Duration(slowMs) * time.Millisecond
+	if c.MissingHost, err = src.getEnum("MISSING_HOST", c.MissingHost, missingHostAllow, missingHostReject); err != nil {
+		return nil, err
+	}
+	if c.AllowTrace, err = src.getBool("ALLOW_TRACE", c.AllowTrace); err != nil {
+		return nil, err
+	}
+	if c.Endpoints, err = parseEndpoints(src.getList("ENDPOINTS", nil)); err != nil {
+		return nil, err
+	}
+	if c.HelloRequestCount, err = src.getBool("HELLO_REQUEST_COUNT", c.HelloRequestCount); err != nil {
+		return nil, err
+	}
+	if c.ForceHTTPS, err = src.getBool("FORCE_HTTPS", c.ForceHTTPS); err != nil {
+		return nil, err
+	}
+	if c.ForceHTTPS && !c.TrustProxy {
+		return nil, fmt.Errorf("FORCE_HTTPS requires TRUST_PROXY, as the original scheme comes from the proxy")
+	}
+	if c.QueryMaxLength, err = src.getInt("QUERY_MAX_LENGTH", c.QueryMaxLength); err != nil {
+		return nil, err
+	}
+	if c.QueryMaxParams, err = src.getInt("QUERY_MAX_PARAMS", c.QueryMaxParams); err != nil {
+		return nil, err
+	}
+	if c.QueryMaxLength <= 0 || c.QueryMaxParams <= 0 {
+		return nil, fmt.Errorf("QUERY_MAX_LENGTH and QUERY_MAX_PARAMS must be positive, got %d and %d", c.QueryMaxLength, c.QueryMaxParams)
+	}
+	for _, limit := range []struct {
+		prefix string
+		limits *map[string]int
+	}{
+		{"QUERY_MAX_LENGTH_", &c.RouteQueryMaxLength},
+		{"QUERY_MAX_PARAMS_", &c.RouteQueryMaxParams},
+	} {
+		for name, v := range src.getPrefixed(limit.prefix) {
+			n, err := strconv.Atoi(v)
+			if err != nil || name == "" || n <= 0 {
+				return nil, fmt.Errorf("%s%s: want a route name and a positive integer", limit.prefix, name)
+			}
+			if *limit.limits == nil {
+				*limit.limits = map[string]int{}
+			}
+			(*limit.limits)[queryLimitKey(name)] = n
+		}
+	}
+	if c.ShutdownGracePeriod <= 0 {
+		return nil, fmt.Errorf("SHUTDOWN_GRACE_PERIOD must be positive, got %s", c.ShutdownGracePeriod)
+	}
+	if c.DrainDelay < 0 || c.DrainDelay >= c.ShutdownGracePeriod {
+		return nil, fmt.Errorf("DRAIN_DELAY must be between 0 and SHUTDOWN_GRACE_PERIOD (%s), got %s", c.ShutdownGracePeriod, c.DrainDelay)
+	}
+	c.settings = src.settings
+	return c, nil
+}
+
+// parseEndpoints parses ENDPOINTS directives, "+name" to enable a route
+// and "-name" to disable it. A later directive for a route overrides an
+// earlier one.
+func parseEndpoints(directives []string) (map[string]bool, error) {
+	if len(directives) == 0 {
+		return nil, nil
+	}
+	endpoints := make(map[string]bool, len(directives))
+	for _, d := range directives {
+		if len(d) < 2 || (d[0] != '+' && d[0] != '-') {
+			return nil, fmt.Errorf("ENDPOINTS: %q must be +name or -name", d)
+		}
+		endpoints[d[1:]] = d[0] == '+'
+	}
+	return endpoints, nil
+}
+
+// reloadConfig loads and validates the configuration again, keeping the
+// current one if the new one is invalid.
+func reloadConfig() {
+	c, err := loadConfig()
+	observeConfigReload(err)
+	if err != nil {
+		log.Printf("config reload rejected, keeping current configuration: %v", err)
+		return
+	}
+	markReloaded(c, currentConfig())
+	config.Store(c)
+	log.Printf("config reloaded")
+}
+
+// markReloaded flags the settings of c whose value or source differs from
+// those of prev, the configuration being replaced.
+func markReloaded(c, prev *Config) {
+	for name, st := range c.settings {
+		old := prev.settings[name]
+		st.Reloaded = old == nil || old.Value != st.Value || old.Source != st.Source
+	}
+}
+
+// handleReloadSignals reloads the configuration on every SIGHUP.
+func handleReloadSignals() {
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	for range hups {
+		log.Printf("received SIGHUP, reloading config")
+		reloadConfig()
+	}
+}
+
+// observeConfigReload records the outcome of a configuration reload in the
+// config_reload metrics.
+func observeConfigReload(err error) {
+	if err != nil {
+		configReloadFailures.Inc()
+		return
+	}
+	configReloads.Inc()
+	configLastReload.SetToCurrentTime()
+}
+
+// Where a setting's value came from, as reported by /config.
+const (
+	settingFromDefault = "default"
+	settingFromEnv     = "env"
+	settingFromFile    = "file"
+)
+
+// setting is a value read by loadConfig and its provenance. Reloaded is
+// set when the last reload changed the value.
+type setting struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Source   string `json:"source"`
+	Reloaded bool   `json:"reloaded,omitempty"`
+}
+
+// configSource resolves setting names, preferring values from the config
+// file over the process environment, and records the source of each.
+type configSource struct {
+	file     map[string]string
+	settings map[string]*setting
+}
+
+// newConfigSource reads path, a file of KEY=VALUE lines in the same format
+// as an env file. Blank lines and lines starting with # are ignored. An
+// empty path yields a source backed by the environment alone.
+func newConfigSource(path string) (configSource, error) {
+	src := configSource{file: map[string]string{}, settings: map[string]*setting{}}
+	if path == "" {
+		return src, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return configSource{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return configSource{}, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		src.file[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	if err := scanner.Err(); err != nil {
+		return configSource{}, err
+	}
+	return src, nil
+}
+
+func (s configSource) get(name string) string {
+	v, ok := s.file[name]
+	from := settingFromFile
+	if !ok {
+		v, from = os.Getenv(name), settingFromEnv
+	}
+	if v == "" {
+		from = settingFromDefault
+	}
+	if _, seen := s.settings[name]; !seen {
+		s.settings[name] = &setting{Name: name, Value: v, Source: from}
+	}
+	return v
+}
+
+// defaulted records def as the value of name when get found it unset.
+func (s configSource) defaulted(name string, def interface{}) {
+	if st := s.settings[name]; st != nil && st.Source == settingFromDefault {
+		st.Value = fmt.Sprint(def)
+	}
+}
+
+func (s configSource) getInt(name string, def int) (int, error) {
+	v := s.get(name)
+	if v == "" {
+		s.defaulted(name, def)
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return n, nil
+}
+
+func (s configSource) getFloat(name string, def float64) (float64, error) {
+	v := s.get(name)
+	if v == "" {
+		s.defaulted(name, def)
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return f, nil
+}
+
+func (s configSource) getDuration(name string, def time.Duration) (time.Duration, error) {
+	v := s.get(name)
+	if v == "" {
+		s.defaulted(name, def)
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", name, err)
+	}
+	return d, nil
+}
+
+func (s configSource) getBool(name string, def bool) (bool, error) {
+	v := s.get(name)
+	if v == "" {
+		s.defaulted(name, def)
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", name, err)
+	}
+	return b, nil
+}
+
+// getEnum returns the value of name, which must be one of allowed.
+func (s configSource) getEnum(name, def string, allowed ...string) (string, error) {
+	v := strings.ToLower(s.get(name))
+	if v == "" {
+		s.defaulted(name, def)
+		return def, nil
+	}
+	for _, a := range allowed {
+		if v == a {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("%s must be one of %s, got %q", name, strings.Join(allowed, ", "), v)
+}
+
+// getList parses a comma-separated list, ignoring empty entries.
+func (s configSource) getList(name string, def []string) []string {
+	v := s.get(name)
+	if v == "" {
+		s.defaulted(name, strings.Join(def, ","))
+		return def
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getPrefixed returns the variables whose names start with prefix, keyed
+// by the rest of the name. Entries from the file override the
+// environment, as with get.
+func (s configSource) getPrefixed(prefix string) map[string]string {
+	vars := map[string]string{}
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 && strings.HasPrefix(kv[:i], prefix) {
+			vars[kv[len(prefix):i]] = kv[i+1:]
+			s.settings[kv[:i]] = &setting{Name: kv[:i], Value: kv[i+1:], Source: settingFromEnv}
+		}
+	}
+	for k, v := range s.file {
+		if strings.HasPrefix(k, prefix) {
+			vars[k[len(prefix):]] = v
+			s.settings[k] = &setting{Name: k, Value: v, Source: settingFromFile}
+		}
+	}
+	return vars
+}
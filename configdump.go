@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// dumpConfig writes the exported settings of c to w as Name=value lines,
+// in declaration order. Settings whose name looks sensitive, as judged for
+// /env, are redacted when set.
+func dumpConfig(w io.Writer, c *Config) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		value := fmt.Sprintf("%v", v.Field(i).Interface())
+		if isSensitiveName(f.Name) && !v.Field(i).IsZero() {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(w, "%s=%s\n", f.Name, value)
+	}
+}
+
+// configHandler serves /config: every setting read when the configuration
+// in effect was loaded, sorted by name, with its value and whether it came
+// from the environment, CONFIG_FILE or the default. Settings changed by
+// the last reload are flagged. Sensitive values are redacted as for /env.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <configHandler>", getOnelineInfo(r))
+
+	c := currentConfig()
+	settings := make([]setting, 0, len(c.settings))
+	for _, st := range c.settings {
+		s := *st
+		if isSensitiveName(s.Name) && s.Value != "" {
+			s.Value = "<redacted>"
+		}
+		settings = append(settings, s)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	writeJSON(w, r, http.StatusOK, struct {
+		Settings []setting `json:"settings"`
+	}{settings})
+
+	httpReqs.Inc()
+}
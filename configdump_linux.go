@@ -0,0 +1,19 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleDumpSignals writes the effective configuration to stderr on every
+// SIGUSR1, for when the HTTP endpoints are locked down.
+func handleDumpSignals() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	for range usr1 {
+		log.Printf("received SIGUSR1, dumping config to stderr")
+		dumpConfig(os.Stderr, currentConfig())
+	}
+}
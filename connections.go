@@ -0,0 +1,29 @@
+package main
+
+import "net/http"
+
+// connectionsInfo counts TCP sockets by state, per address family and in
+// total.
+type connectionsInfo struct {
+	TCP   map[string]int `json:"tcp"`
+	TCP6  map[string]int `json:"tcp6,omitempty"`
+	Total map[string]int `json:"total"`
+}
+
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <connectionsHandler>", getOnelineInfo(r))
+
+	info, err := getConnections()
+	if err == errUnsupportedPlatform {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+	if err != nil {
+		handlerError(r, errKindProcRead, "getConnections()", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// tcpStates maps the hex st column of /proc/net/tcp to state names.
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+	"0C": "NEW_SYN_RECV",
+}
+
+func getConnections() (connectionsInfo, error) {
+	info := connectionsInfo{Total: map[string]int{}}
+	var err error
+	if info.TCP, err = countTCPStates("/proc/net/tcp"); err != nil {
+		return info, err
+	}
+	// tcp6 is absent when IPv6 is disabled.
+	if info.TCP6, err = countTCPStates("/proc/net/tcp6"); err != nil && !os.IsNotExist(err) {
+		return info, err
+	}
+	for _, counts := range []map[string]int{info.TCP, info.TCP6} {
+		for state, n := range counts {
+			info.Total[state] += n
+		}
+	}
+	return info, nil
+}
+
+// countTCPStates counts the sockets in a /proc/net/tcp-format file by
+// state.
+func countTCPStates(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		state, ok := tcpStates[strings.ToUpper(fields[3])]
+		if !ok {
+			state = "UNKNOWN"
+		}
+		counts[state]++
+	}
+	return counts, scanner.Err()
+}
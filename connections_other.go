@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getConnections() (connectionsInfo, error) {
+	return connectionsInfo{}, errUnsupportedPlatform
+}
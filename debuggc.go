@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+type gcReport struct {
+	HeapAllocBefore uint64  `json:"heap_alloc_before_bytes"`
+	HeapAllocAfter  uint64  `json:"heap_alloc_after_bytes"`
+	HeapInuseBefore uint64  `json:"heap_inuse_before_bytes"`
+	HeapInuseAfter  uint64  `json:"heap_inuse_after_bytes"`
+	Reclaimed       int64   `json:"reclaimed_bytes"`
+	NumGC           uint32  `json:"num_gc"`
+	DurationMs      float64 `json:"duration_ms"`
+}
+
+// debugGCHandler serves POST /debug/gc: it forces a garbage collection
+// and reports the heap before and after. It is disabled unless
+// DebugEndpoints is set and requires the admin token.
+func debugGCHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <debugGCHandler>", getOnelineInfo(r))
+
+	if !currentConfig().DebugEndpoints {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		rejectRequest(w, rejectMethodNotAllowed, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !requireToken(w, r) {
+		return
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	runtime.GC()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	writeJSON(w, r, http.StatusOK, gcReport{
+		HeapAllocBefore: before.HeapAlloc,
+		HeapAllocAfter:  after.HeapAlloc,
+		HeapInuseBefore: before.HeapInuse,
+		HeapInuseAfter:  after.HeapInuse,
+		Reclaimed:       int64(before.HeapAlloc) - int64(after.HeapAlloc),
+		NumGC:           after.NumGC,
+		DurationMs:      float64(elapsed) / float64(time.Millisecond),
+	})
+
+	httpReqs.Inc()
+}
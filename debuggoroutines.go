@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	// minGoroutineDump and maxGoroutineDump bound the buffer
+	// /debug/goroutines hands to runtime.Stack, which grows from the first
+	// to the second until the dump fits.
+	minGoroutineDump = 64 << 10
+	maxGoroutineDump = 16 << 20
+)
+
+// goroutineGroup is the goroutines whose stacks share a top frame.
+type goroutineGroup struct {
+	Function string `json:"function"`
+	// Location is the file:line of the top frame of the first goroutine
+	// in the group.
+	Location string         `json:"location"`
+	Count    int            `json:"count"`
+	States   map[string]int `json:"states"`
+}
+
+type goroutinesReport struct {
+	Goroutines int              `json:"goroutines"`
+	Truncated  bool             `json:"truncated,omitempty"`
+	Groups     []goroutineGroup `json:"groups"`
+}
+
+// goroutineStacks returns the stacks of all goroutines, as printed by
+// runtime.Stack, and whether they had to be cut off at maxGoroutineDump.
+func goroutineStacks() ([]byte, bool) {
+	for size := minGoroutineDump; ; size *= 2 {
+		buf := make([]byte, size)
+		n := runtime.Stack(buf, true)
+		if n < size {
+			return buf[:n], false
+		}
+		if size >= maxGoroutineDump {
+			return buf[:n], true
+		}
+	}
+}
+
+// groupGoroutines parses a runtime.Stack dump and groups its goroutines by
+// top frame, largest group first.
+func groupGoroutines(dump string) goroutinesReport {
+	var report goroutinesReport
+	index := map[string]int{}
+	for _, block := range strings.Split(strings.TrimSpace(dump), "\n\n") {
+		lines := strings.Split(block, "\n")
+		if !strings.HasPrefix(lines[0], "goroutine ") {
+			continue
+		}
+		report.Goroutines++
+		state := "unknown"
+		if i, j := strings.IndexByte(lines[0], '['), strings.IndexByte(lines[0], ']'); i >= 0 && j > i {
+			state = strings.SplitN(lines[0][i+1:j], ",", 2)[0]
+		}
+		function, location := "unknown", ""
+		if len(lines) > 1 {
+			function = lines[1]
+			if i := strings.LastIndexByte(function, '('); i > 0 {
+				function = function[:i]
+			}
+		}
+		if len(lines) > 2 {
+			if fields := strings.Fields(lines[2]); len(fields) > 0 {
+				location = fields[0]
+			}
+		}
+		i, ok := index[function]
+		if !ok {
+			i = len(report.Groups)
+			index[function] = i
+			report.Groups = append(report.Groups, goroutineGroup{Function: function, Location: location, States: map[string]int{}})
+		}
+		report.Groups[i].Count++
+		report.Groups[i].States[state]++
+	}
+	sort.SliceStable(report.Groups, func(i, j int) bool { return report.Groups[i].Count > report.Groups[j].Count })
+	return report
+}
+
+// debugGoroutinesHandler serves /debug/goroutines, the stacks of all
+// goroutines grouped by top frame, or as runtime.Stack prints them with
+// ?format=text. It is disabled unless DebugEndpoints is set and requires
+// the admin token.
+func debugGoroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <debugGoroutinesHandler>", getOnelineInfo(r))
+
+	if !currentConfig().DebugEndpoints {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireToken(w, r) || !checkQuery(w, r) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		http.Error(w, "format must be json or text", http.StatusBadRequest)
+		return
+	}
+
+	dump, truncated := goroutineStacks()
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(dump)
+		if truncated {
+			w.Write([]byte("\n... truncated\n"))
+		}
+	} else {
+		report := groupGoroutines(string(dump))
+		report.Truncated = truncated
+		writeJSON(w, r, http.StatusOK, report)
+	}
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// expectedCollectors are the collectors registerMetrics must register,
+// keyed by variable name. Add new metrics here too, so /debug/metrics/check
+// catches one that was declared but never registered. tlsHandshakeErrors
+// is left out as it is only registered when TLS is enabled.
+func expectedCollectors() map[string]prometheus.Collector {
+	return map[string]prometheus.Collector{
+		"httpReqs":              httpReqs,
+		"requestCount":          requestCount,
+		"requestDuration":       requestDuration,
+		"responseSize":          responseSize,
+		"requestsByMethod":      requestsByMethod,
+		"requestsByScheme":      requestsByScheme,
+		"gzipSeconds":           gzipSeconds,
+		"brotliSeconds":         brotliSeconds,
+		"responsesCompressed":   responsesCompressed,
+		"responsesUncompressed": responsesUncompressed,
+		"responseMaxBytes":      responseMaxBytes,
+		"requestsInFlight":      requestsInFlight,
+		"requestQueueWait":      requestQueueWait,
+		"requestPhaseDuration":  requestPhaseDuration,
+		"appGoroutines":         appGoroutines,
+		"streamsActive":         streamsActive,
+		"outboundInFlight":      outboundInFlight,
+		"outboundQueued":        outboundQueued,
+		"notFoundResponses":     notFoundResponses,
+		"requestsRejected":      requestsRejected,
+		"handlerErrors":         handlerErrors,
+		"helloResponses":        helloResponses,
+		"helloDegraded":         helloDegraded,
+		"configReloads":         configReloads,
+		"configReloadFailures":  configReloadFailures,
+		"configLastReload":      configLastReload,
+		"processCount":          processCount,
+		"processCountMax":       processCountMax,
+		"processCountMin":       processCountMin,
+		"procReadErrors":        procReadErrors,
+		"psQueued":              psQueued,
+		"psRejected":            psRejected,
+		"psCacheHits":           psCacheHits,
+		"psCacheMisses":         psCacheMisses,
+		"applicationRequests":   applicationRequests,
+		"routeRequests":         routeRequests,
+		"routesRequested":       routesRequested,
+		"contextCancellations":  contextCancellations,
+		"slowRequests":          slowRequests,
+		"acceptErrors":          acceptErrors,
+		"gatewayLastDiscovery":  gatewayLastDiscovery,
+	}
+}
+
+type metricsCheck struct {
+	OK bool `json:"ok"`
+	// Unregistered lists expected collectors missing from the registry.
+	Unregistered []string `json:"unregistered"`
+	// NoSamples lists registered collectors with nothing to report yet,
+	// such as vectors whose labels have not been seen. It does not fail
+	// the check.
+	NoSamples []string `json:"no_samples"`
+	// Metrics are the names of every metric family the registry gathers.
+	Metrics []string `json:"metrics"`
+}
+
+// checkMetrics verifies that every expected collector is registered with
+// reg. Registering a collector that is already there fails with
+// AlreadyRegisteredError; one that succeeds was missing and is
+// unregistered again, so the check has no side effects.
+func checkMetrics(reg *prometheus.Registry) (metricsCheck, error) {
+	check := metricsCheck{Unregistered: []string{}, NoSamples: []string{}, Metrics: []string{}}
+	for name, c := range expectedCollectors() {
+		err := reg.Register(c)
+		if err == nil {
+			reg.Unregister(c)
+			check.Unregistered = append(check.Unregistered, name)
+			continue
+		}
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			return check, err
+		}
+		if !hasSamples(c) {
+			check.NoSamples = append(check.NoSamples, name)
+		}
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return check, err
+	}
+	for _, mf := range families {
+		check.Metrics = append(check.Metrics, mf.GetName())
+	}
+	sort.Strings(check.Unregistered)
+	sort.Strings(check.NoSamples)
+	check.OK = len(check.Unregistered) == 0
+	return check, nil
+}
+
+// hasSamples reports whether c currently collects at least one metric.
+func hasSamples(c prometheus.Collector) bool {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	n := 0
+	for range ch {
+		n++
+	}
+	return n > 0
+}
+
+// debugMetricsCheckHandler serves /debug/metrics/check, a self-test of
+// metric registration. It answers 500 if an expected collector is not
+// registered and is disabled unless DebugEndpoints is set.
+func debugMetricsCheckHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <debugMetricsCheckHandler>", getOnelineInfo(r))
+
+	if !currentConfig().DebugEndpoints {
+		http.NotFound(w, r)
+		return
+	}
+	check, err := checkMetrics(registry)
+	if err != nil {
+		handlerError(r, errKindMetrics, "checkMetrics()", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	code := http.StatusOK
+	if !check.OK {
+		code = http.StatusInternalServerError
+	}
+	writeJSON(w, r, code, check)
+
+	httpReqs.Inc()
+}
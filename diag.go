@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxBatchBody bounds the JSON list of names /batch accepts.
+const maxBatchBody = 64 << 10
+
+// Section statuses reported by collectDiagnostics.
+const (
+	diagOK       = "ok"
+	diagError    = "error"
+	diagTimedOut = "timed out"
+)
+
+type diagSection struct {
+	Status     string      `json:"status"`
+	DurationMs float64     `json:"duration_ms,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// diagnostics are the named sources /diag gathers. Each may block, so they
+// are run concurrently and abandoned once the time budget is spent.
+var diagnostics = map[string]func(ctx context.Context) (interface{}, error){
+	"hostname": func(ctx context.Context) (interface{}, error) {
+		return os.Hostname()
+	},
+	"local_ip": func(ctx context.Context) (interface{}, error) {
+		return getLocalIP(), nil
+	},
+	"gateway": func(ctx context.Context) (interface{}, error) {
+		gw, err := discoverGateway()
+		if err != nil {
+			return nil, err
+		}
+		if noGateway(gw) {
+			return gatewayInfo{Gateway: "none"}, nil
+		}
+		return gatewayInfo{Gateway: gw.String(), RoutableAddr: getRoutableIP(gw)}, nil
+	},
+	"processes": func(ctx context.Context) (interface{}, error) {
+		processes, err := listProcesses(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]int{"count": len(processes)}, nil
+	},
+	"disk": func(ctx context.Context) (interface{}, error) {
+		return getDiskUsage("/")
+	},
+	"kubernetes": func(ctx context.Context) (interface{}, error) {
+		fields := map[string]string{}
+		for field, name := range currentConfig().KubernetesEnv {
+			if v := os.Getenv(name); v != "" {
+				fields[field] = v
+			}
+		}
+		return fields, nil
+	},
+	"uptime": func(ctx context.Context) (interface{}, error) {
+		return time.Since(startTime).String(), nil
+	},
+	"meminfo": func(ctx context.Context) (interface{}, error) {
+		return getHostMemInfo()
+	},
+}
+
+func diagnosticNames() []string {
+	names := make([]string, 0, len(diagnostics))
+	for name := range diagnostics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// collectDiagnostics runs the named diagnostics concurrently and returns
+// what finished before ctx expired; the rest are marked as timed out.
+func collectDiagnostics(ctx context.Context, names []string) map[string]diagSection {
+	type result struct {
+		name    string
+		section diagSection
+	}
+	results := make(chan result, len(names))
+	for _, name := range names {
+		name, fn := name, diagnostics[name]
+		go func() {
+			start := time.Now()
+			data, err := fn(ctx)
+			section := diagSection{Status: diagOK, Data: data}
+			if err != nil {
+				section = diagSection{Status: diagError, Error: err.Error()}
+			}
+			section.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+			results <- result{name, section}
+		}()
+	}
+
+	sections := make(map[string]diagSection, len(names))
+	for range names {
+		select {
+		case res := <-results:
+			sections[res.name] = res.section
+		case <-ctx.Done():
+			for _, name := range names {
+				if _, ok := sections[name]; !ok {
+					sections[name] = diagSection{Status: diagTimedOut}
+				}
+			}
+			return sections
+		}
+	}
+	return sections
+}
+
+// diagHandler reports every diagnostic in one response within the
+// configured DiagTimeout.
+func diagHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <diagHandler>", getOnelineInfo(r))
+
+	ctx, cancel := context.WithTimeout(r.Context(), currentConfig().DiagTimeout)
+	defer cancel()
+	defer observeCancellation(ctx, r)
+	writeJSON(w, r, http.StatusOK, collectDiagnostics(ctx, diagnosticNames()))
+
+	httpReqs.Inc()
+}
+
+// batchHandler serves POST /batch, whose body is a JSON list of
+// diagnostic names, e.g. ["hostname","gateway"]. Only those are run, as
+// /diag would within DiagTimeout, and reported keyed by name with their
+// errors inline. Unknown names are rejected with 400.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <batchHandler>", getOnelineInfo(r))
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		rejectRequest(w, rejectMethodNotAllowed, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var requested []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&requested); err != nil {
+		http.Error(w, fmt.Sprintf("body must be a JSON list of diagnostic names: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(requested) == 0 {
+		http.Error(w, "no diagnostics requested", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool, len(requested))
+	names := make([]string, 0, len(requested))
+	for _, name := range requested {
+		if _, ok := diagnostics[name]; !ok {
+			http.Error(w, fmt.Sprintf("unknown diagnostic %q: must be one of %s", name, strings.Join(diagnosticNames(), ", ")), http.StatusBadRequest)
+			return
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), currentConfig().DiagTimeout)
+	defer cancel()
+	defer observeCancellation(ctx, r)
+	writeJSON(w, r, http.StatusOK, collectDiagnostics(ctx, names))
+
+	httpReqs.Inc()
+}
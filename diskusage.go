@@ -0,0 +1,36 @@
+package main
+
+import "net/http"
+
+type diskUsage struct {
+	Path           string  `json:"path"`
+	TotalBytes     uint64  `json:"total_bytes"`
+	FreeBytes      uint64  `json:"free_bytes"`
+	AvailableBytes uint64  `json:"available_bytes"`
+	PercentUsed    float64 `json:"percent_used"`
+}
+
+func diskUsageHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <diskUsageHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		path = "/"
+	}
+	du, err := getDiskUsage(path)
+	if err == errUnsupportedPlatform {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+	if err != nil {
+		writeJSON(w, r, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, du)
+
+	httpReqs.Inc()
+}
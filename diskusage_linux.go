@@ -0,0 +1,24 @@
+package main
+
+import "syscall"
+
+func getDiskUsage(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	bsize := uint64(st.Bsize)
+	du := diskUsage{
+		Path:           path,
+		TotalBytes:     st.Blocks * bsize,
+		FreeBytes:      st.Bfree * bsize,
+		AvailableBytes: st.Bavail * bsize,
+	}
+	// Like df, report usage relative to the space available to
+	// unprivileged users.
+	used := du.TotalBytes - du.FreeBytes
+	if used+du.AvailableBytes > 0 {
+		du.PercentUsed = float64(used) / float64(used+du.AvailableBytes) * 100
+	}
+	return du, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getDiskUsage(path string) (diskUsage, error) {
+	return diskUsage{}, errUnsupportedPlatform
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// resolvConfPath is read by /dnsconfig.
+const resolvConfPath = "/etc/resolv.conf"
+
+type dnsConfig struct {
+	Path        string   `json:"path"`
+	Nameservers []string `json:"nameservers"`
+	Search      []string `json:"search"`
+	Options     []string `json:"options"`
+	// Domain is the obsolete "domain" directive, which resolvers treat as
+	// a single-entry search list.
+	Domain string `json:"domain,omitempty"`
+}
+
+// parseResolvConf parses the contents of resolv.conf. As in glibc, the
+// last search or domain line wins.
+func parseResolvConf(data string) dnsConfig {
+	conf := dnsConfig{Nameservers: []string{}, Search: []string{}, Options: []string{}}
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.Nameservers = append(conf.Nameservers, fields[1])
+		case "search":
+			conf.Search = fields[1:]
+			conf.Domain = ""
+		case "domain":
+			conf.Domain = fields[1]
+			conf.Search = []string{}
+		case "options":
+			conf.Options = append(conf.Options, fields[1:]...)
+		}
+	}
+	return conf
+}
+
+// dnsConfigHandler serves /dnsconfig, the resolver configuration from
+// /etc/resolv.conf, to explain what the DNS lookups made by the app use.
+func dnsConfigHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <dnsConfigHandler>", getOnelineInfo(r))
+
+	data, err := ioutil.ReadFile(resolvConfPath)
+	if os.IsNotExist(err) {
+		writeJSON(w, r, http.StatusNotFound, map[string]string{"error": resolvConfPath + " does not exist"})
+		return
+	}
+	if err != nil {
+		handlerError(r, errKindDNSConfig, "ioutil.ReadFile()", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	conf := parseResolvConf(string(data))
+	conf.Path = resolvConfPath
+	writeJSON(w, r, http.StatusOK, conf)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// envHandler prints the process environment as sorted KEY=VALUE lines,
+// with sensitive values redacted. It requires the admin token.
+func envHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <envHandler>", getOnelineInfo(r))
+
+	if !requireToken(w, r) {
+		return
+	}
+
+	env := redactEnv(os.Environ())
+	sort.Strings(env)
+	for _, kv := range env {
+		fmt.Fprintln(w, kv)
+	}
+
+	httpReqs.Inc()
+}
+
+// envVarHandler serves /env/<name> with the value of that single
+// variable, redacted like /env, or 404 if it is unset. Names are matched
+// exactly, as they are case-sensitive. Like /env, it requires the admin
+// token.
+func envVarHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <envVarHandler>", getOnelineInfo(r))
+
+	if !requireToken(w, r) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/env/")
+	value, ok := os.LookupEnv(name)
+	if name == "" || strings.Contains(name, "/") || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if isSensitiveName(name) {
+		value = "<redacted>"
+	}
+	fmt.Fprintln(w, value)
+
+	httpReqs.Inc()
+}
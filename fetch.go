@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Upper bounds for the FETCH_* settings.
+const (
+	maxFetchPhaseTimeout = 30 * time.Second
+	maxFetchTimeout      = time.Minute
+	maxFetchBody         = 16 << 20
+	maxFetchAttempts     = 5
+	maxFetchBackoff      = 5 * time.Second
+)
+
+// Phases of an outbound fetch, in order, as reported by /fetch.
+const (
+	fetchPhaseDNS     = "dns"
+	fetchPhaseConnect = "connect"
+	fetchPhaseTLS     = "tls"
+	fetchPhaseWait    = "wait"
+	fetchPhaseBody    = "body"
+)
+
+// errFetchBodyTooLarge is returned once a downstream body exceeds
+// FetchMaxBody.
+var errFetchBodyTooLarge = errors.New("response body too large")
+
+// errFetchDenied is returned when /fetch is about to connect to an
+// internal address and FetchAllowPrivate is not set.
+var errFetchDenied = errors.New("destination address not allowed")
+
+// internalNets are the ranges /fetch refuses to dial unless
+// FetchAllowPrivate is set, on top of loopback, link-local (which holds
+// the 169.254.169.254 metadata service), multicast and unspecified
+// addresses.
+var internalNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"fc00::/7",
+	} {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// internalIP reports whether ip is not a public unicast address.
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkFetchAddr is the dialer's Control hook. It sees each address after
+// name resolution, just before connecting, so a name that resolves to an
+// internal address, or rebinds to one, is refused all the same.
+func checkFetchAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || internalIP(ip) {
+		return fmt.Errorf("%s: %w", host, errFetchDenied)
+	}
+	return nil
+}
+
+type fetchResult struct {
+	URL string `json:"url"`
+	// Attempt numbers the fetch, from 1, when /fetch was asked to retry.
+	Attempt int   `json:"attempt,omitempty"`
+	Status  int   `json:"status,omitempty"`
+	Bytes   int64 `json:"bytes"`
+	// Timings holds the duration of each phase reached, in milliseconds.
+	Timings map[string]float64 `json:"timings_ms"`
+	TotalMs float64            `json:"total_ms"`
+	// Phase is the phase in progress when the fetch failed.
+	Phase   string `json:"phase,omitempty"`
+	Timeout bool   `json:"timeout,omitempty"`
+	// Denied is set when the destination resolved to an internal address.
+	Denied bool   `json:"denied,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// fetchTrace follows a request through its phases via httptrace. Dials to
+// several addresses may run concurrently, hence the mutex.
+type fetchTrace struct {
+	mu      sync.Mutex
+	phase   string
+	started time.Time
+	timings map[string]float64
+}
+
+func (t *fetchTrace) enter(phase string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advance(phase)
+}
+
+// stop ends the trace, returning the phase that was in progress.
+func (t *fetchTrace) stop() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phase := t.phase
+	t.advance("")
+	return phase
+}
+
+// advance closes the current phase, adding its duration to t.timings, and
+// starts the next one. t.mu must be held.
+func (t *fetchTrace) advance(phase string) {
+	now := time.Now()
+	if t.phase != "" {
+		t.timings[t.phase] += float64(now.Sub(t.started)) / float64(time.Millisecond)
+	}
+	t.phase = phase
+	t.started = now
+}
+
+func (t *fetchTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.enter(fetchPhaseDNS) },
+		ConnectStart:         func(string, string) { t.enter(fetchPhaseConnect) },
+		TLSHandshakeStart:    func() { t.enter(fetchPhaseTLS) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.enter(fetchPhaseWait) },
+		GotFirstResponseByte: func() { t.enter(fetchPhaseBody) },
+	}
+}
+
+// fetchResponse is the body of /fetch: the outcome of the last attempt
+// and, when retries were asked for, every attempt in order.
+type fetchResponse struct {
+	fetchResult
+	Attempts []fetchResult `json:"attempts,omitempty"`
+}
+
+// failed reports whether res is worth retrying: the fetch failed, other
+// than by being denied, or the downstream answered with a server error.
+func (res fetchResult) failed() bool {
+	return !res.Denied && (res.Error != "" || res.Status >= http.StatusInternalServerError)
+}
+
+// fetch GETs target with the FETCH_* limits from c and reports how long
+// each phase took. Redirects are not followed.
+func fetch(ctx context.Context, c *Config, target string) fetchResult {
+	res := fetchResult{URL: target, Timings: map[string]float64{}}
+	ctx, cancel := context.WithTimeout(ctx, c.FetchTimeout)
+	defer cancel()
+
+	trace := &fetchTrace{timings: res.Timings}
+	dialer := &net.Dialer{Timeout: c.FetchConnectTimeout}
+	if !c.FetchAllowPrivate {
+		dialer.Control = checkFetchAddr
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: c.FetchTLSTimeout,
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+			DisableKeepAlives:   true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	start := time.Now()
+	err := func() error {
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace.clientTrace()), http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		res.Status = resp.StatusCode
+		max := int64(c.FetchMaxBody)
+		res.Bytes, err = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, max+1))
+		if err == nil && res.Bytes > max {
+			res.Bytes = max
+			err = errFetchBodyTooLarge
+		}
+		return err
+	}()
+	res.TotalMs = float64(time.Since(start)) / float64(time.Millisecond)
+	phase := trace.stop()
+	if err != nil {
+		res.Phase = phase
+		res.Error = err.Error()
+		var ne net.Error
+		res.Timeout = errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+		res.Denied = errors.Is(err, errFetchDenied)
+	}
+	return res
+}
+
+// fetchHandler serves /fetch?url=..., an egress probe that GETs an http
+// or https URL and reports per-phase timings. Slow or oversized
+// downstreams are answered with 504 or 502 naming the phase that failed.
+// attempts (up to maxFetchAttempts) retries failures and 5xx answers,
+// waiting backoff (up to maxFetchBackoff) before the first retry and twice
+// as long before each one after; all attempts share FetchTimeout. It makes
+// outbound requests, so it requires the admin token, and answers 403 for
+// hosts outside FetchAllowedHosts and for internal addresses.
+func fetchHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <fetchHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	if !requireToken(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	target := q.Get("url")
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	c := currentConfig()
+	if len(c.FetchAllowedHosts) > 0 && !hostAllowed(u.Host, c.FetchAllowedHosts) {
+		rejectRequest(w, rejectFetchDenied, http.StatusForbidden, "fetch destination not allowed")
+		return
+	}
+	attempts := 1
+	if v := q.Get("attempts"); v != "" {
+		if attempts, err = strconv.Atoi(v); err != nil || attempts < 1 || attempts > maxFetchAttempts {
+			http.Error(w, fmt.Sprintf("attempts must be between 1 and %d", maxFetchAttempts), http.StatusBadRequest)
+			return
+		}
+	}
+	var backoff time.Duration
+	if v := q.Get("backoff"); v != "" {
+		if backoff, err = time.ParseDuration(v); err != nil || backoff < 0 || backoff > maxFetchBackoff {
+			http.Error(w, fmt.Sprintf("backoff must be a duration between 0 and %s", maxFetchBackoff), http.StatusBadRequest)
+			return
+		}
+	}
+	// Waiting for an outbound worker and between attempts counts against
+	// FetchTimeout.
+	ctx, cancel := context.WithTimeout(r.Context(), c.FetchTimeout)
+	defer cancel()
+	defer observeCancellation(ctx, r)
+	var resp fetchResponse
+	for i := 1; i <= attempts; i++ {
+		if i > 1 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+			}
+			backoff *= 2
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		var res fetchResult
+		if !runOutbound(ctx, w, func() { res = fetch(ctx, c, target) }) {
+			return
+		}
+		if attempts > 1 {
+			res.Attempt = i
+			resp.Attempts = append(resp.Attempts, res)
+		}
+		resp.fetchResult = res
+		if !res.failed() {
+			break
+		}
+	}
+	res := resp.fetchResult
+	code := http.StatusOK
+	switch {
+	case res.Denied:
+		code = http.StatusForbidden
+	case res.Timeout:
+		code = http.StatusGatewayTimeout
+	case res.Error != "":
+		code = http.StatusBadGateway
+	}
+	if res.Denied {
+		requestsRejected.WithLabelValues(rejectFetchDenied).Inc()
+	}
+	if res.Error != "" {
+		logFromCtx(r.Context()).Printf("fetch %s failed during %s: %s", target, res.Phase, res.Error)
+	}
+	writeJSON(w, r, code, resp)
+
+	httpReqs.Inc()
+}
+
+// validateFetchLimits checks the FETCH_* settings against their bounds.
+func validateFetchLimits(c *Config) error {
+	for _, d := range []struct {
+		name      string
+		value, to time.Duration
+	}{
+		{"FETCH_CONNECT_TIMEOUT", c.FetchConnectTimeout, maxFetchPhaseTimeout},
+		{"FETCH_TLS_TIMEOUT", c.FetchTLSTimeout, maxFetchPhaseTimeout},
+		{"FETCH_TIMEOUT", c.FetchTimeout, maxFetchTimeout},
+	} {
+		if d.value <= 0 || d.value > d.to {
+			return fmt.Errorf("%s must be between 0 and %s, got %s", d.name, d.to, d.value)
+		}
+	}
+	if c.FetchMaxBody <= 0 || c.FetchMaxBody > maxFetchBody {
+		return fmt.Errorf("FETCH_MAX_BODY must be between 1 and %d, got %d", maxFetchBody, c.FetchMaxBody)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+type fsInfo struct {
+	WorkingDir string            `json:"working_dir,omitempty"`
+	Executable string            `json:"executable,omitempty"`
+	Umask      string            `json:"umask,omitempty"`
+	Errors     map[string]string `json:"errors,omitempty"`
+}
+
+// fsInfoHandler reports the working directory, executable path and umask,
+// the usual suspects when file permissions misbehave in a container.
+func fsInfoHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <fsInfoHandler>", getOnelineInfo(r))
+
+	info := fsInfo{Errors: map[string]string{}}
+	var err error
+	if info.WorkingDir, err = os.Getwd(); err != nil {
+		info.Errors["working_dir"] = err.Error()
+	}
+	if info.Executable, err = os.Executable(); err != nil {
+		info.Errors["executable"] = err.Error()
+	}
+	if umask, err := getUmask(); err != nil {
+		info.Errors["umask"] = err.Error()
+	} else {
+		info.Umask = fmt.Sprintf("%04o", umask)
+	}
+	if len(info.Errors) == 0 {
+		info.Errors = nil
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// getUmask reads the umask from /proc/self/status (Linux 4.7+). Older
+// kernels lack the field, so fall back to setting and restoring it, which
+// is serialized here but briefly affects files created concurrently by
+// other goroutines.
+func getUmask() (int, error) {
+	if f, err := os.Open("/proc/self/status"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if v := strings.TrimPrefix(scanner.Text(), "Umask:"); v != scanner.Text() {
+				n, err := strconv.ParseInt(strings.TrimSpace(v), 8, 32)
+				return int(n), err
+			}
+		}
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	umask := syscall.Umask(0)
+	syscall.Umask(umask)
+	return umask, nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getUmask() (int, error) {
+	return 0, errUnsupportedPlatform
+}
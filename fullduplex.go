@@ -0,0 +1,20 @@
+//go:build go1.21
+// +build go1.21
+
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// enableFullDuplex lets an HTTP/1 handler keep reading the request body
+// after it has started writing the response.
+func enableFullDuplex(w http.ResponseWriter) error {
+	return http.NewResponseController(w).EnableFullDuplex()
+}
+
+// setReadDeadline bounds how long reads of the request body may block.
+func setReadDeadline(w http.ResponseWriter, t time.Time) error {
+	return http.NewResponseController(w).SetReadDeadline(t)
+}
@@ -0,0 +1,18 @@
+//go:build !go1.21
+// +build !go1.21
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+func enableFullDuplex(w http.ResponseWriter) error {
+	return errors.New("full duplex HTTP/1 requires go1.21")
+}
+
+func setReadDeadline(w http.ResponseWriter, t time.Time) error {
+	return errors.New("read deadlines from a handler require go1.21")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jackpal/gateway"
+)
+
+// gatewayProbeTimeout bounds the connect made by /gateway?probe=true.
+const gatewayProbeTimeout = 2 * time.Second
+
+type gatewayInfo struct {
+	// Gateway is "none" when there is no default route.
+	Gateway      string        `json:"gateway"`
+	RoutableAddr string        `json:"routable_address,omitempty"`
+	Probe        *gatewayProbe `json:"probe,omitempty"`
+}
+
+// gatewayProbe is the outcome of a TCP connect to the gateway. A refused
+// connection still means the gateway answered, so it counts as reachable
+// and its round trip is reported.
+type gatewayProbe struct {
+	Addr      string  `json:"addr"`
+	Reachable bool    `json:"reachable"`
+	Refused   bool    `json:"refused,omitempty"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// probeGateway connects to port on gw and times how long it takes to get
+// an answer, whether the connection is accepted or refused.
+func probeGateway(ctx context.Context, gw net.IP, port int) *gatewayProbe {
+	p := &gatewayProbe{Addr: net.JoinHostPort(gw.String(), strconv.Itoa(port))}
+	dialer := net.Dialer{Timeout: gatewayProbeTimeout}
+	start := time.Now()
+	conn, err := dialer.DialContext(ctx, "tcp", p.Addr)
+	rtt := time.Since(start)
+	switch {
+	case err == nil:
+		conn.Close()
+		p.Reachable = true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		p.Reachable, p.Refused = true, true
+	default:
+		p.Error = err.Error()
+		return p
+	}
+	p.LatencyMs = float64(rtt) / float64(time.Millisecond)
+	return p
+}
+
+// discoverGateway wraps gateway.DiscoverGateway, recording in
+// gateway_last_discovery_timestamp_seconds each time a gateway is found.
+func discoverGateway() (net.IP, error) {
+	gw, err := gateway.DiscoverGateway()
+	if err == nil && !noGateway(gw) {
+		gatewayLastDiscovery.SetToCurrentTime()
+	}
+	return gw, err
+}
+
+// gatewayHandler serves /gateway, the default gateway and the local
+// address used to reach it. With ?probe=true it also connects to the
+// gateway on GatewayProbePort to report whether it answers and how fast.
+func gatewayHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <gatewayHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	probe, err := strconv.ParseBool(r.URL.Query().Get("probe"))
+	if err != nil && r.URL.Query().Get("probe") != "" {
+		http.Error(w, "probe must be true or false", http.StatusBadRequest)
+		return
+	}
+	gw, err := discoverGateway()
+	if err != nil {
+		handlerError(r, errKindGateway, "gateway.DiscoverGateway()", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	info := gatewayInfo{Gateway: "none"}
+	if !noGateway(gw) {
+		info.Gateway = gw.String()
+		info.RoutableAddr = getRoutableIP(gw)
+		if probe {
+			ctx, cancel := context.WithTimeout(r.Context(), gatewayProbeTimeout)
+			defer cancel()
+			port := currentConfig().GatewayProbePort
+			if !runOutbound(ctx, w, func() { info.Probe = probeGateway(ctx, gw, port) }) {
+				return
+			}
+		}
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
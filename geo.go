@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+)
+
+// defaultGeoHeaders are the geolocation headers set by common CDNs and
+// load balancers. GeoHeaders adds to them.
+var defaultGeoHeaders = []string{
+	"CF-IPCountry",
+	"CF-IPCity",
+	"CF-IPContinent",
+	"CloudFront-Viewer-Country",
+	"CloudFront-Viewer-Country-Region",
+	"CloudFront-Viewer-City",
+	"X-AppEngine-Country",
+	"X-AppEngine-Region",
+	"X-AppEngine-City",
+	"X-AppEngine-CityLatLong",
+	"X-Client-Geo-Location",
+	"X-Geo-Country",
+	"X-Geo-Region",
+	"X-Geo-City",
+}
+
+type geoInfo struct {
+	// Headers holds the geolocation headers present on the request.
+	Headers map[string]string `json:"headers"`
+	// Checked lists every header looked for.
+	Checked []string `json:"checked"`
+}
+
+// geoHandler serves /geo, the geolocation headers a CDN or edge proxy
+// added to the request, to check that they reach the app.
+func geoHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <geoHandler>", getOnelineInfo(r))
+
+	info := geoInfo{Headers: map[string]string{}}
+	seen := map[string]bool{}
+	for _, name := range append(defaultGeoHeaders, currentConfig().GeoHeaders...) {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		info.Checked = append(info.Checked, name)
+		if v := r.Header.Get(key); v != "" {
+			info.Headers[name] = v
+		}
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
@@ -3,7 +3,11 @@ module github.com/orimanabu/openshift-sample-go
 go 1.15
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/jackpal/gateway v1.0.6
 	github.com/mitchellh/go-ps v1.0.0
 	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	golang.org/x/sync v0.1.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// greetingPollInterval is how often GreetingFile is checked for
+	// changes. Polling, rather than inotify, also catches the symlink swap
+	// Kubernetes does when a mounted ConfigMap is updated.
+	greetingPollInterval = 5 * time.Second
+	// maxGreetingFile bounds how much of GreetingFile is read.
+	maxGreetingFile = 4096
+)
+
+// fileGreeting holds the trimmed contents of GreetingFile, or "" when it
+// is unset, missing or empty.
+var fileGreeting atomic.Value
+
+// defaultGreeting is shown to hosts without a HOST_GREETING_<host>: the
+// contents of GreetingFile if it can be read, else Greeting.
+func defaultGreeting() string {
+	if g, _ := fileGreeting.Load().(string); g != "" {
+		return g
+	}
+	return currentConfig().Greeting
+}
+
+// watchGreetingFile loads path into fileGreeting, then reloads it
+// whenever its modification time or size changes, until ctx is cancelled.
+// While the file cannot be read, Greeting is used instead.
+func watchGreetingFile(ctx context.Context, path string) {
+	var last os.FileInfo
+	var lastErr string
+	ticker := time.NewTicker(greetingPollInterval)
+	defer ticker.Stop()
+	for {
+		fi, err := os.Stat(path)
+		if err == nil && (last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size()) {
+			var g string
+			if g, err = readGreetingFile(path); err == nil {
+				last = fi
+				fileGreeting.Store(g)
+				log.Printf("GREETING_FILE: loaded greeting %q from %s", g, path)
+			}
+		}
+		if err != nil {
+			last = nil
+			fileGreeting.Store("")
+			if err.Error() != lastErr {
+				log.Printf("GREETING_FILE: %v; using GREETING", err)
+			}
+			lastErr = err.Error()
+		} else {
+			lastErr = ""
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func readGreetingFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxGreetingFile))
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Content codings the compression middleware produces.
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+// encoder is the part of gzip.Writer and brotli.Writer that compressWriter
+// uses.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+var encoders = map[string]*sync.Pool{
+	encodingGzip: {
+		New: func() interface{} { return gzip.NewWriter(nil) },
+	},
+	encodingBrotli: {
+		New: func() interface{} { return brotli.NewWriter(nil) },
+	},
+}
+
+// accepts reports whether the Accept-Encoding header lists coding, or *,
+// with a non-zero quality.
+func accepts(r *http.Request, coding string) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(v, ",") {
+			fields := strings.Split(part, ";")
+			c := strings.ToLower(strings.TrimSpace(fields[0]))
+			if c != coding && c != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range fields[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if f, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = f
+					}
+				}
+			}
+			return q > 0
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the coding for r among those enabled in c:
+// Brotli when the client accepts it, whatever its preference, then gzip.
+// It returns "" when the response should not be compressed.
+func negotiateEncoding(c *Config, r *http.Request) string {
+	switch {
+	case c.Brotli && accepts(r, encodingBrotli):
+		return encodingBrotli
+	case c.Gzip && accepts(r, encodingGzip):
+		return encodingGzip
+	}
+	return ""
+}
+
+// compressWriter compresses the response body with encoding, deciding
+// when the headers are written: responses that already have a
+// Content-Encoding, or that have no body, are passed through unchanged. Up
+// to minBytes of the body are buffered first, and a response that ends
+// smaller than that is sent uncompressed.
+type compressWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	encoding string
+	minBytes int
+	enc      encoder
+	// spent is the time spent in enc, added to the encoding's
+	// compression_seconds_total counter by close.
+	spent time.Duration
+	code  int
+	buf   []byte
+	// wroteHeader is set once the handler has written its header, and
+	// committed once it has been sent on, compressed or not.
+	wroteHeader bool
+	committed   bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	cw.code = code
+	h := cw.Header()
+	switch {
+	case h.Get("Content-Encoding") != "" || cw.r.Method == http.MethodHead ||
+		code == http.StatusNoContent || code == http.StatusNotModified || code < http.StatusOK:
+		cw.commit(false)
+	case cw.minBytes == 0:
+		cw.commit(true)
+	default:
+		if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < cw.minBytes {
+			cw.commit(false)
+		}
+	}
+}
+
+// commit sends the header, compressing the body from now on if compress
+// is set, and writes out what has been buffered.
+func (cw *compressWriter) commit(compress bool) error {
+	cw.committed = true
+	if compress {
+		h := cw.Header()
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		cw.enc = encoders[cw.encoding].Get().(encoder)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.code)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.write(buf)
+	return err
+}
+
+func (cw *compressWriter) write(b []byte) (int, error) {
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	start := time.Now()
+	defer func() { cw.spent += time.Since(start) }()
+	return cw.enc.Write(b)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if _, ok := cw.Header()["Content-Type"]; !ok && len(b) > 0 {
+			// Sniff before compressing, as net/http would only see
+			// compressed bytes.
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.committed {
+		if len(cw.buf)+len(b) < cw.minBytes {
+			cw.buf = append(cw.buf, b...)
+			return len(b), nil
+		}
+		if err := cw.commit(true); err != nil {
+			return 0, err
+		}
+	}
+	return cw.write(b)
+}
+
+// Flush pushes out what has been compressed so far, so streaming handlers
+// keep working. A response flushed before reaching minBytes is assumed to
+// be a stream and compressed.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.committed {
+		cw.commit(true)
+	}
+	if cw.enc != nil {
+		start := time.Now()
+		cw.enc.Flush()
+		cw.spent += time.Since(start)
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close sends a response that stayed under minBytes uncompressed, or
+// finishes the compressed stream and returns its encoder to the pool. It
+// reports whether the response was compressed.
+func (cw *compressWriter) close() bool {
+	if cw.wroteHeader && !cw.committed {
+		cw.commit(false)
+	}
+	if cw.enc == nil {
+		return false
+	}
+	start := time.Now()
+	cw.enc.Close()
+	compressionSeconds[cw.encoding].Add((cw.spent + time.Since(start)).Seconds())
+	cw.enc.Reset(nil)
+	encoders[cw.encoding].Put(cw.enc)
+	cw.enc = nil
+	return true
+}
+
+// compressionSeconds maps each encoding to its compression_seconds_total
+// counter.
+var compressionSeconds map[string]prometheus.Counter
+
+// withCompression compresses responses of at least GzipMinBytes for
+// clients that accept an enabled coding, as chosen by negotiateEncoding,
+// counting each response in http_responses_compressed_total or
+// http_responses_uncompressed_total.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if !c.Gzip && !c.Brotli {
+			next.ServeHTTP(w, r)
+			responsesUncompressed.Inc()
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(c, r)
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			responsesUncompressed.Inc()
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, r: r, encoding: encoding, minBytes: c.GzipMinBytes}
+		next.ServeHTTP(cw, r)
+		if cw.close() {
+			responsesCompressed.Inc()
+		} else {
+			responsesUncompressed.Inc()
+		}
+	})
+}
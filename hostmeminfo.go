@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// hostMemInfo is /proc/meminfo with every field converted to bytes, except
+// the few counted in pages (HugePages_Total and friends), which are kept
+// as they are.
+type hostMemInfo map[string]uint64
+
+// parseMemInfo parses the contents of /proc/meminfo, skipping lines it
+// cannot read.
+func parseMemInfo(data string) hostMemInfo {
+	info := hostMemInfo{}
+	for _, line := range strings.Split(data, "\n") {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) == 0 {
+			continue
+		}
+		n, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == "kB" {
+			n *= 1024
+		}
+		info[line[:i]] = n
+	}
+	return info
+}
+
+// hostMemInfoHandler serves /host/meminfo, the host's memory as seen in
+// /proc/meminfo, as opposed to the Go runtime's.
+func hostMemInfoHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <hostMemInfoHandler>", getOnelineInfo(r))
+
+	info, err := getHostMemInfo()
+	if err == errUnsupportedPlatform {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+	if err != nil {
+		handlerError(r, errKindProcRead, "getHostMemInfo()", err)
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,12 @@
+package main
+
+import "io/ioutil"
+
+func getHostMemInfo() (hostMemInfo, error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		procReadErrors.WithLabelValues("meminfo").Inc()
+		return nil, err
+	}
+	return parseMemInfo(string(data)), nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func getHostMemInfo() (hostMemInfo, error) {
+	return nil, errUnsupportedPlatform
+}
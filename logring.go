@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// logRingLines is how many recent log lines are kept for /logs/tail.
+	logRingLines = 1000
+	// maxLogRingLine truncates longer lines kept in the ring.
+	maxLogRingLine = 4096
+	// defaultLogTail is how many lines /logs/tail returns without n.
+	defaultLogTail = 100
+)
+
+// logRing keeps the most recent log lines in memory.
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+}
+
+func newLogRing(n int) *logRing {
+	return &logRing{lines: make([]string, 0, n)}
+}
+
+// Write records each line of p. The log package calls it once per line.
+func (lr *logRing) Write(p []byte) (int, error) {
+	text := strings.TrimSuffix(string(p), "\n")
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	for _, line := range strings.Split(text, "\n") {
+		if len(line) > maxLogRingLine {
+			line = line[:maxLogRingLine]
+		}
+		if len(lr.lines) < cap(lr.lines) {
+			lr.lines = append(lr.lines, line)
+		} else {
+			lr.lines[lr.next] = line
+		}
+		lr.next = (lr.next + 1) % cap(lr.lines)
+	}
+	return len(p), nil
+}
+
+// tail returns up to the n most recent lines, oldest first.
+func (lr *logRing) tail(n int) []string {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	if n > len(lr.lines) {
+		n = len(lr.lines)
+	}
+	out := make([]string, 0, n)
+	start := lr.next - n
+	if len(lr.lines) < cap(lr.lines) {
+		start = len(lr.lines) - n
+	}
+	for i := 0; i < n; i++ {
+		out = append(out, lr.lines[(start+i+cap(lr.lines))%cap(lr.lines)])
+	}
+	return out
+}
+
+var recentLogs = newLogRing(logRingLines)
+
+// logOutput is where the access and request loggers write; every line
+// also goes into recentLogs.
+var logOutput io.Writer = io.MultiWriter(os.Stdout, recentLogs)
+
+func init() {
+	log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+}
+
+// logsTailHandler serves the last n log lines, as text or, with
+// ?format=json, as a JSON array. It requires the admin token.
+func logsTailHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <logsTailHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	if !requireToken(w, r) {
+		return
+	}
+	n := defaultLogTail
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 || n > logRingLines {
+			http.Error(w, fmt.Sprintf("n must be between 1 and %d", logRingLines), http.StatusBadRequest)
+			return
+		}
+	}
+	lines := recentLogs.tail(n)
+	switch r.URL.Query().Get("format") {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	case "json":
+		writeJSON(w, r, http.StatusOK, lines)
+	default:
+		http.Error(w, "format must be text or json", http.StatusBadRequest)
+		return
+	}
+
+	httpReqs.Inc()
+}
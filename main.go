@@ -1,26 +1,41 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
 	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/jackpal/gateway"
 	"github.com/mitchellh/go-ps"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v3"
 )
 
 var (
-	version  = "1.2"
-	httpReqs = prometheus.NewCounter(prometheus.CounterOpts{
+	version = "1.2"
+	// buildDate is set at build time with
+	// -ldflags "-X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)".
+	buildDate = ""
+	// startTime is when the process started; time.Since(startTime) uses
+	// the monotonic clock.
+	startTime = time.Now()
+	httpReqs  = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "http_requests_total",
 		Help: "How many HTTP requests processed, partitioned by status code and HTTP method.",
 	})
@@ -38,77 +53,701 @@ var (
 		Help:    "A histogram of response sizes for requests.",
 		Buckets: []float64{0, 2, 4, 6, 8, 10, 12, 14, 16, 18, 20},
 	}, []string{"code", "method"})
+	requestsByMethod = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_by_method_total",
+		Help: "Requests received by the app server, partitioned by method; other methods count as OTHER.",
+	}, []string{"method"})
+	requestsByScheme = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_by_scheme_total",
+		Help: "Requests received by the app server, partitioned by the scheme the client used (http or https), as told by a trusted proxy where TRUST_PROXY is set.",
+	}, []string{"scheme"})
+	gzipSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gzip_compression_seconds_total",
+		Help: "Time spent gzip-compressing responses, including handing the compressed bytes to the connection.",
+	})
+	brotliSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "brotli_compression_seconds_total",
+		Help: "Time spent Brotli-compressing responses, including handing the compressed bytes to the connection.",
+	})
+	responsesCompressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_responses_compressed_total",
+		Help: "Responses sent gzip- or Brotli-compressed.",
+	})
+	responsesUncompressed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_responses_uncompressed_total",
+		Help: "Responses sent without compression, because GZIP and BROTLI are off, the client accepts neither enabled coding, or the response has no body.",
+	})
+	responseMaxBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_response_max_bytes",
+		Help: "Largest response body served per registered route since startup or the last POST /metrics/reset.",
+	}, []string{"path"})
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Number of requests currently being handled by the app server.",
+	})
+	requestQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "http_request_queue_wait_seconds",
+		Help:    "Time requests waited for a slot under MAX_CONCURRENT_REQUESTS before being handled or rejected.",
+		Buckets: []float64{.0001, .001, .005, .01, .05, .1, .25, .5, 1, 2.5, 5},
+	})
+	requestPhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "request_phase_duration_seconds",
+		Help:    "Time spent per request in the middleware stack and in the route handler.",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+	}, []string{"phase"})
+	appGoroutines = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "app_goroutines",
+		Help: "Long-lived goroutines started by the app itself, partitioned by subsystem.",
+	}, []string{"name"})
+	streamsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_streams_active",
+		Help: "Long-lived streaming responses currently open.",
+	})
+	outboundInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outbound_requests_in_flight",
+		Help: "Outbound probes currently running on behalf of requests, limited by MAX_OUTBOUND.",
+	})
+	outboundQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outbound_queue_depth",
+		Help: "Requests waiting for a free outbound worker.",
+	})
+	notFoundResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "http_not_found_total",
+		Help: "Requests for unmatched paths answered 404 without reaching a handler.",
+	})
+	requestsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_rejected_total",
+		Help: "Requests rejected before reaching a handler, partitioned by reason.",
+	}, []string{"reason"})
+	helloResponses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hello_responses_total",
+		Help: "Hello responses served, the denominator for hello_degraded_total.",
+	})
+	helloDegraded = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "hello_degraded_total",
+		Help: "Hello responses served with some host information missing.",
+	})
+	configReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "config_reloads_total",
+		Help: "Number of successful configuration reloads.",
+	})
+	configReloadFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "config_reload_failures_total",
+		Help: "Number of configuration reloads rejected as invalid.",
+	})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "config_last_reload_timestamp_seconds",
+		Help: "Unix time of the last successful configuration reload.",
+	})
+	handlerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "handler_errors_total",
+		Help: "Internal errors hit by handlers, including ones they recovered from, partitioned by route and error kind.",
+	}, []string{"path", "kind"})
+	processCount = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "process_count",
+		Help: "Number of processes seen at the last periodic enumeration.",
+	})
+	processCountMax = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "process_count_max",
+		Help: "Maximum process count seen over the rolling sample window.",
+	})
+	processCountMin = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "process_count_min",
+		Help: "Minimum process count seen over the rolling sample window.",
+	})
+	procReadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proc_read_errors_total",
+		Help: "Failed reads of /proc files, partitioned by file (cmdline, stat, status, ...).",
+	}, []string{"file"})
+	psQueued = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ps_enumerations_queued",
+		Help: "Callers currently waiting for a process enumeration slot.",
+	})
+	psRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ps_enumerations_rejected_total",
+		Help: "Process enumerations given up after waiting psQueueTimeout for a slot.",
+	})
+	psCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ps_cache_hits_total",
+		Help: "Process list requests served from the cache or from an enumeration shared with another request.",
+	})
+	psCacheMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ps_cache_misses_total",
+		Help: "Process list requests that ran an enumeration of their own.",
+	})
+	applicationRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "application_requests_total",
+		Help: "Requests served by registered routes other than the probes (/readyz, /ready/ports); metrics scrapes and unmatched paths are not counted either.",
+	})
+	routeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_route_requests_total",
+		Help: "Requests served, partitioned by registered route.",
+	}, []string{"path"})
+	routesRequested = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_routes_requested",
+		Help: "Number of distinct registered routes that have served at least one request since startup.",
+	})
+	gatewayLastDiscovery = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_last_discovery_timestamp_seconds",
+		Help: "Unix time a default gateway was last discovered, by \"/\", /diag or /gateway; 0 if never.",
+	})
+	acceptErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "listener_accept_errors_total",
+		Help: "Errors accepting connections, by listener (app or metrics) and kind: transient ones are retried after a backoff, a permanent one shuts the server down.",
+	}, []string{"listener", "kind"})
+	slowRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_slow_requests_total",
+		Help: "Requests that took longer than SLOW_REQUEST_MS, partitioned by registered route.",
+	}, []string{"path"})
+	contextCancellations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "request_context_cancellations_total",
+		Help: "Requests abandoned because the client went away or a timeout expired, partitioned by registered route.",
+	}, []string{"path"})
+)
+
+// Listen addresses of the app and metrics servers, set from AppPort and
+// MetricsPort at startup. They are the same when metrics are served on
+// the app port.
+var (
+	appAddr     = ":8080"
+	metricsAddr = ":9090"
 )
 
+const (
+	// processSampleInterval is how often the process list is enumerated
+	// for the process_count gauges.
+	processSampleInterval = 15 * time.Second
+	// processSampleWindow is the number of samples kept for the rolling
+	// min/max gauges (5 minutes at the default interval).
+	processSampleWindow = 20
+)
+
+// registry holds every collector the metrics server exposes, instead of
+// the global default registry.
+var registry = newRegistry()
+
+// newRegistry returns a new registry with the application's metrics
+// registered, so tests can use one in isolation. The Go runtime and
+// process collectors are only added to registry, in init.
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	registerMetrics(reg)
+	return reg
+}
+
 func init() {
 	log.Printf("initializing this app...")
-	prometheus.MustRegister(httpReqs)
-	prometheus.MustRegister(requestCount)
-	prometheus.MustRegister(requestDuration)
-	prometheus.MustRegister(responseSize)
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+}
+
+// registerMetrics registers the application's collectors with reg. A
+// collector that is already registered there is not an error: the
+// existing one is reused, so registering twice is harmless.
+func registerMetrics(reg prometheus.Registerer) {
+	httpReqs = register(reg, httpReqs).(prometheus.Counter)
+	requestCount = register(reg, requestCount).(*prometheus.CounterVec)
+	requestDuration = register(reg, requestDuration).(*prometheus.HistogramVec)
+	responseSize = register(reg, responseSize).(*prometheus.HistogramVec)
+	requestsByMethod = register(reg, requestsByMethod).(*prometheus.CounterVec)
+	for _, method := range append(knownMethods, "OTHER") {
+		requestsByMethod.WithLabelValues(method)
+	}
+	requestsByScheme = register(reg, requestsByScheme).(*prometheus.CounterVec)
+	for _, scheme := range []string{"http", "https"} {
+		requestsByScheme.WithLabelValues(scheme)
+	}
+	gzipSeconds = register(reg, gzipSeconds).(prometheus.Counter)
+	brotliSeconds = register(reg, brotliSeconds).(prometheus.Counter)
+	compressionSeconds = map[string]prometheus.Counter{
+		encodingGzip:   gzipSeconds,
+		encodingBrotli: brotliSeconds,
+	}
+	responsesCompressed = register(reg, responsesCompressed).(prometheus.Counter)
+	responsesUncompressed = register(reg, responsesUncompressed).(prometheus.Counter)
+	responseMaxBytes = register(reg, responseMaxBytes).(*prometheus.GaugeVec)
+	requestsInFlight = register(reg, requestsInFlight).(prometheus.Gauge)
+	requestQueueWait = register(reg, requestQueueWait).(prometheus.Histogram)
+	requestPhaseDuration = register(reg, requestPhaseDuration).(*prometheus.HistogramVec)
+	appGoroutines = register(reg, appGoroutines).(*prometheus.GaugeVec)
+	streamsActive = register(reg, streamsActive).(prometheus.Gauge)
+	outboundInFlight = register(reg, outboundInFlight).(prometheus.Gauge)
+	outboundQueued = register(reg, outboundQueued).(prometheus.Gauge)
+	notFoundResponses = register(reg, notFoundResponses).(prometheus.Counter)
+	requestsRejected = register(reg, requestsRejected).(*prometheus.CounterVec)
+	for _, reason := range rejectReasons {
+		requestsRejected.WithLabelValues(reason)
+	}
+	handlerErrors = register(reg, handlerErrors).(*prometheus.CounterVec)
+	helloResponses = register(reg, helloResponses).(prometheus.Counter)
+	helloDegraded = register(reg, helloDegraded).(prometheus.Counter)
+	configReloads = register(reg, configReloads).(prometheus.Counter)
+	configReloadFailures = register(reg, configReloadFailures).(prometheus.Counter)
+	configLastReload = register(reg, configLastReload).(prometheus.Gauge)
+	processCount = register(reg, processCount).(prometheus.Gauge)
+	processCountMax = register(reg, processCountMax).(prometheus.Gauge)
+	processCountMin = register(reg, processCountMin).(prometheus.Gauge)
+	procReadErrors = register(reg, procReadErrors).(*prometheus.CounterVec)
+	for file := range procFiles {
+		procReadErrors.WithLabelValues(file)
+	}
+	psQueued = register(reg, psQueued).(prometheus.Gauge)
+	psRejected = register(reg, psRejected).(prometheus.Counter)
+	psCacheHits = register(reg, psCacheHits).(prometheus.Counter)
+	psCacheMisses = register(reg, psCacheMisses).(prometheus.Counter)
+	applicationRequests = register(reg, applicationRequests).(prometheus.Counter)
+	routeRequests = register(reg, routeRequests).(*prometheus.CounterVec)
+	routesRequested = register(reg, routesRequested).(prometheus.Gauge)
+	contextCancellations = register(reg, contextCancellations).(*prometheus.CounterVec)
+	slowRequests = register(reg, slowRequests).(*prometheus.CounterVec)
+	acceptErrors = register(reg, acceptErrors).(*prometheus.CounterVec)
+	gatewayLastDiscovery = register(reg, gatewayLastDiscovery).(prometheus.Gauge)
+	if built, err := time.Parse(time.RFC3339, buildDate); err == nil {
+		register(reg, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "build_age_seconds",
+			Help: "Seconds since this binary was built.",
+		}, func() float64 {
+			return time.Since(built).Seconds()
+		}))
+	} else if buildDate != "" {
+		log.Printf("ignoring unparseable buildDate %q: %v", buildDate, err)
+	}
+}
+
+// registerConfigMetrics exports the startup values of the grace period
+// and timeouts as config_*_seconds gauges. A zero server timeout means
+// none is applied.
+func registerConfigMetrics(reg prometheus.Registerer, c *Config, srv *http.Server) {
+	for _, m := range []struct {
+		name, help string
+		value      time.Duration
+	}{
+		{"config_shutdown_grace_seconds", "Configured SHUTDOWN_GRACE_PERIOD.", c.ShutdownGracePeriod},
+		{"config_diag_timeout_seconds", "Configured DIAG_TIMEOUT.", c.DiagTimeout},
+		{"config_request_queue_timeout_seconds", "Configured REQUEST_QUEUE_TIMEOUT.", c.RequestQueueTimeout},
+		{"config_read_timeout_seconds", "App server ReadTimeout; 0 means none.", srv.ReadTimeout},
+		{"config_read_header_timeout_seconds", "App server ReadHeaderTimeout; 0 means none.", srv.ReadHeaderTimeout},
+		{"config_write_timeout_seconds", "App server WriteTimeout; 0 means none.", srv.WriteTimeout},
+		{"config_idle_timeout_seconds", "App server IdleTimeout; 0 means none.", srv.IdleTimeout},
+	} {
+		g := register(reg, prometheus.NewGauge(prometheus.GaugeOpts{Name: m.name, Help: m.help})).(prometheus.Gauge)
+		g.Set(m.value.Seconds())
+	}
+
+	features := register(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "feature_enabled",
+		Help: "1 if the optional feature was enabled at startup, else 0.",
+	}, []string{"feature"})).(*prometheus.GaugeVec)
+	for name, on := range enabledFeatures(c) {
+		v := 0.0
+		if on {
+			v = 1
+		}
+		features.WithLabelValues(name).Set(v)
+	}
+}
+
+// enabledFeatures reports which optional features c turns on, for the
+// feature_enabled gauge.
+func enabledFeatures(c *Config) map[string]bool {
+	return map[string]bool{
+		"tls":                  c.tlsEnabled(),
+		"admin_token":          c.AdminToken != "",
+		"metrics_auth":         c.MetricsToken != "" || c.MetricsUser != "",
+		"allowed_hosts":        len(c.AllowedHosts) > 0,
+		"trust_proxy":          c.TrustProxy,
+		"proc_reader":          c.ProcReader,
+		"debug_endpoints":      c.DebugEndpoints,
+		"profiling":            c.ProfileDir != "" || c.StartupProfile != "",
+		"zombie_reaper":        c.ReapZombies,
+		"update_check":         c.UpdateCheckURL != "",
+		"chaos":                c.ChaosDelay > 0 || c.ChaosFailRate > 0,
+		"warmup":               c.WarmupRequests > 0,
+		"concurrency_limit":    c.MaxConcurrentRequests > 0,
+		"compression":          c.Gzip,
+		"brotli":               c.Brotli,
+		"slow_request_log":     c.SlowRequest > 0,
+		"log_query":            c.LogQuery,
+		"not_found_rate_limit": c.NotFoundRateLimit > 0,
+		"drain_delay":          c.DrainDelay > 0,
+		"greeting_file":        c.GreetingFile != "",
+		"top_mem_log":          c.TopMemInterval > 0,
+		"metrics_on_app_port":  c.metricsOnAppPort(),
+		"metrics_cors":         len(c.MetricsCORSOrigins) > 0,
+	}
+}
+
+// register registers c with reg and returns it or, if an equivalent
+// collector is already registered, the existing one. Any other error is a
+// programming mistake and panics, as with MustRegister.
+func register(reg prometheus.Registerer, c prometheus.Collector) prometheus.Collector {
+	if err := reg.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector
+		}
+		panic(err)
+	}
+	return c
 }
 
 func main() {
-	//http.HandleFunc("/", helloHandler)
-	// Instrument helloHandler
-	helloHandler := http.HandlerFunc(doHelloHandler)
-	wrappedHelloHandler := promhttp.InstrumentHandlerCounter(
-		requestCount,
-		promhttp.InstrumentHandlerDuration(
-			requestDuration,
-			promhttp.InstrumentHandlerResponseSize(
-				responseSize,
-				helloHandler),
-		),
-	)
-	http.Handle("/", wrappedHelloHandler)
-	http.HandleFunc("/oneline", onelineHandler)
-	http.HandleFunc("/ps", psHandler)
-	http.HandleFunc("/version", versionHandler)
-
-	// serve metrics.
-	log.Printf("serving metrics at: %s", ":9090")
-	go http.ListenAndServe(":9090", promhttp.Handler())
-
-	// serve our handlers.
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Panicf("error while serving: %s", err)
+	// Install the signal handler before anything else, so a SIGTERM sent
+	// while we are still starting up is not lost. Until the app server's
+	// shutdown hook is registered, a signal stops whatever has been
+	// started so far and exits immediately. A second signal always exits
+	// at once.
+	var started, failed int32
+	stopped := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	goTracked("signal handler", func() {
+		sig := <-sigs
+		// A second signal abandons the graceful shutdown, in case it is
+		// stuck.
+		goTracked("second signal handler", func() {
+			sig := <-sigs
+			log.Printf("received %s during shutdown, exiting immediately", sig)
+			os.Exit(1)
+		})
+		grace := defaultConfig().ShutdownGracePeriod
+		if c, ok := config.Load().(*Config); ok {
+			grace = c.ShutdownGracePeriod
+		}
+		if atomic.LoadInt32(&started) == 0 {
+			exitDuringStartup(sig, takeShutdownHooks(), grace, func(code int) {
+				if atomic.LoadInt32(&failed) != 0 {
+					code = 1
+				}
+				os.Exit(code)
+			})
+		}
+		log.Printf("received %s, shutting down", sig)
+		runShutdownHooks(grace)
+		close(stopped)
+	})
+	// listenerFailed shuts the server down gracefully, as a signal would,
+	// after a listener failed for good, and makes it exit with status 1.
+	listenerFailed := func(name string, err error) {
+		log.Printf("%s server: %v, shutting down", name, err)
+		atomic.StoreInt32(&failed, 1)
+		select {
+		case sigs <- syscall.SIGTERM:
+		default:
+		}
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("invalid configuration: %v", err)
+	}
+	config.Store(c)
+	if c.StartupProfile != "" {
+		goWithShutdown("profiler", func(ctx context.Context) {
+			runStartupProfile(ctx, c.StartupProfile, c.StartupProfileDuration, c.ProfileDir, c.ProfileInterval, c.ProfileKeep)
+		})
 	}
+	goTracked("reload signal handler", handleReloadSignals)
+	goTracked("config dump signal handler", handleDumpSignals)
+	seedChaos(c.ChaosSeed)
+	if err := openAuditLog(c.AuditLog); err != nil {
+		log.Fatalf("AUDIT_LOG: %v", err)
+	}
+
+	if c.StartupDelay > 0 {
+		delayStartup(c.StartupDelay, startupDelayLogInterval)
+	}
+
+	// serve metrics, on their own port unless they share the app's.
+	appAddr = fmt.Sprintf(":%d", c.AppPort)
+	metricsAddr = fmt.Sprintf(":%d", c.MetricsPort)
+	metricsHandler := withMetricsCORS(withMetricsAuth(promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: c.MetricsOpenMetrics}))))
+	metricsShared := c.metricsOnAppPort()
+	if metricsShared {
+		metricsAddr = appAddr
+		logMetricsOnAppPort(c)
+	} else {
+		metricsServer := &http.Server{Addr: metricsAddr, Handler: metricsHandler}
+		log.Printf("serving metrics at: %s", metricsServer.Addr)
+		goTracked("metrics server", func() {
+			ln, err := net.Listen("tcp", metricsServer.Addr)
+			if err != nil {
+				listenerFailed("metrics", err)
+				return
+			}
+			if err := metricsServer.Serve(&acceptListener{Listener: ln, name: "metrics"}); !serverStopped(err) {
+				listenerFailed("metrics", err)
+			}
+		})
+		onShutdown("metrics server", metricsServer.Shutdown)
+	}
+
+	initProcessSlots(c.PSMaxConcurrent)
+	goWithShutdown("outbound workers", func(ctx context.Context) {
+		runOutboundWorkers(ctx, c.MaxOutbound)
+	})
+	goWithShutdown("process sampler", func(ctx context.Context) {
+		sampleProcessCount(ctx, processSampleInterval, processSampleWindow)
+	})
+	if c.TopMemInterval > 0 {
+		if hasProcFS {
+			goWithShutdown("top memory logger", func(ctx context.Context) {
+				logTopMem(ctx, c.TopMemInterval, c.TopMemCount)
+			})
+		} else {
+			log.Printf("TOP_MEM_INTERVAL: not supported on %s", runtime.GOOS)
+		}
+	}
+	if c.ReapZombies && os.Getpid() == 1 {
+		goWithShutdown("zombie reaper", reapZombies)
+	}
+	if c.GreetingFile != "" {
+		goWithShutdown("greeting watcher", func(ctx context.Context) {
+			watchGreetingFile(ctx, c.GreetingFile)
+		})
+	}
+	if c.StartupProfile == "" && c.ProfileDir != "" {
+		goWithShutdown("profiler", func(ctx context.Context) {
+			runProfiler(ctx, c.ProfileDir, c.ProfileInterval, c.ProfileKeep)
+		})
+	}
+
+	router := newRouter(c)
+	if c.WarmupRequests > 0 {
+		atomic.StoreInt32(&warmingUp, 1)
+		goTracked("warmup", func() {
+			warmup(router, c.WarmupRequests)
+			atomic.StoreInt32(&warmingUp, 0)
+		})
+	}
+	var appHandler http.Handler = newAppHandler(router)
+	if metricsShared {
+		appHandler = withMetricsPath(metricsHandler, appHandler)
+	}
+	appServer := &http.Server{Addr: appAddr, Handler: appHandler}
+	if c.tlsEnabled() {
+		appServer.ErrorLog = newTLSErrorLog()
+	}
+	appServer.ConnState = trackConnState
+	onShutdown("app server", shutdownAppServer(appServer))
+	if c.DrainDelay > 0 {
+		onShutdown("drain", drainDelay(c.DrainDelay))
+	}
+	registerConfigMetrics(registry, c, appServer)
+	goWithShutdown("readiness checker", func(ctx context.Context) {
+		runReadinessChecks(ctx, c.ReadinessInterval, c.ReadinessFailureThreshold)
+	})
+	atomic.StoreInt32(&started, 1)
+
+	// serve our handlers. The listener is our own, rather than
+	// ListenAndServe's, to set the TCP keep-alive period.
+	lc := net.ListenConfig{KeepAlive: c.TCPKeepAlive}
+	tcpLn, err := lc.Listen(context.Background(), "tcp", appServer.Addr)
+	if err == nil {
+		ln := &acceptListener{Listener: tcpLn, name: "app"}
+		if c.tlsEnabled() {
+			log.Printf("serving TLS at: %s", appServer.Addr)
+			err = appServer.ServeTLS(ln, c.TLSCertFile, c.TLSKeyFile)
+		} else {
+			err = appServer.Serve(ln)
+		}
+	}
+	if !serverStopped(err) {
+		listenerFailed("app", err)
+	}
+	<-stopped
+	log.Printf("server stopped")
+	if atomic.LoadInt32(&failed) != 0 {
+		os.Exit(1)
+	}
+}
+
+// serverStopped reports whether err, as returned by ListenAndServe, only
+// means that the server was shut down.
+func serverStopped(err error) bool {
+	return errors.Is(err, http.ErrServerClosed) || errors.Is(err, net.ErrClosed)
 }
 
+// startupDelayLogInterval is how often delayStartup logs the time left.
+const startupDelayLogInterval = 5 * time.Second
+
+// delayStartup sleeps for d, logging the time left every interval. The
+// signal handler is already installed, so SIGTERM still exits meanwhile.
+func delayStartup(d, interval time.Duration) {
+	log.Printf("STARTUP_DELAY: waiting %s before listening", d)
+	deadline := time.Now().Add(d)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			log.Printf("STARTUP_DELAY: done")
+			return
+		case now := <-ticker.C:
+			log.Printf("STARTUP_DELAY: %s left", deadline.Sub(now).Round(time.Second))
+		}
+	}
+}
+
+// warmingUp is 1 while warmup runs. /readyz reports not ready meanwhile,
+// and with WarmupReject set app routes answer 503.
+var warmingUp int32
+
+func isWarmingUp() bool {
+	return atomic.LoadInt32(&warmingUp) == 1
+}
+
+// warmup sends n requests for "/" straight to the router h, bypassing the
+// network and the middleware (so ALLOWED_HOSTS, chaos and WarmupReject
+// don't apply), to prime lazily initialized state. It runs alongside the
+// app server, which /readyz keeps out of rotation until it is done.
+func warmup(h http.Handler, n int) {
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "localhost"
+		req.RemoteAddr = "127.0.0.1:0"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			log.Printf("warmup request %d: status %d", i+1, rec.Code)
+		}
+	}
+	log.Printf("warmup: %d requests completed in %s", n, time.Since(start))
+}
+
+// getLocalIP returns the address pickLocalIP chooses among those of the
+// host's interfaces.
 func getLocalIP() string {
-	addrs, err := net.InterfaceAddrs()
+	ifaces, err := net.Interfaces()
 	if err != nil {
 		return ""
 	}
-	for _, address := range addrs {
-		// check the address type and if it is not a loopback the display it
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String()
+	var candidates []localAddr
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, address := range addrs {
+			if ipnet, ok := address.(*net.IPNet); ok {
+				candidates = append(candidates, localAddr{ip: ipnet.IP, zone: iface.Name})
+			}
+		}
+	}
+	return pickLocalIP(candidates, currentConfig().IncludeLinkLocal)
+}
+
+// localAddr is an interface address, with the name of its interface as
+// zone.
+type localAddr struct {
+	ip   net.IP
+	zone string
+}
+
+// pickLocalIP returns the first non-loopback IPv4 address, falling back to
+// the first global IPv6 address. IPv6 link-local addresses are only used
+// when includeLinkLocal is set, and are shown with their zone
+// (fe80::1%eth0) since they are ambiguous without it.
+func pickLocalIP(addrs []localAddr, includeLinkLocal bool) string {
+	var global6, linkLocal6 string
+	for _, a := range addrs {
+		switch {
+		case a.ip.IsLoopback():
+		case a.ip.To4() != nil:
+			return a.ip.String()
+		case a.ip.IsLinkLocalUnicast():
+			if linkLocal6 == "" {
+				linkLocal6 = (&net.IPAddr{IP: a.ip, Zone: a.zone}).String()
 			}
+		case global6 == "":
+			global6 = a.ip.String()
 		}
 	}
+	if global6 != "" {
+		return global6
+	}
+	if includeLinkLocal {
+		return linkLocal6
+	}
 	return ""
 }
 
-func getProcCmdArgs(p *ps.UnixProcess) []string {
+// noGateway reports whether gw, as returned without error by
+// gateway.DiscoverGateway, is missing: some platforms report a nil or
+// unspecified address rather than an error.
+func noGateway(gw net.IP) bool {
+	return gw == nil || gw.IsUnspecified()
+}
+
+// getRoutableIP returns the local address the kernel picks to reach gw,
+// which on multi-homed hosts may differ from getLocalIP. Connecting a UDP
+// socket performs the route lookup without sending any packets.
+func getRoutableIP(gw net.IP) string {
+	conn, err := net.Dial("udp", net.JoinHostPort(gw.String(), "9"))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+func getProcCmdArgs(p ps.Process) []string {
 	cmdPath := fmt.Sprintf("/proc/%d/cmdline", p.Pid())
 	data, err := ioutil.ReadFile(cmdPath)
 	if err != nil {
+		procReadErrors.WithLabelValues("cmdline").Inc()
 		return nil
 	}
-	args := strings.Split(string(bytes.TrimRight(data, string("\x00"))), string(byte(0)))
+	args := splitNulls(data)
 	return args
 }
 
 func getProcesses() {
-	processes, err := ps.Processes()
-	if err != nil {
-		fmt.Printf("ps.Processes(): %v\n", err)
-	}
-	for _, p := range processes {
-		fmt.Printf("* %s\t%s\n", p.Executable(), getProcCmdArgs(p.(*ps.UnixProcess)))
+	processes, err := listProcesses(context.Background())
+	printProcesses(os.Stdout, processes, err)
+}
+
+// sampleProcessCount periodically enumerates processes and updates the
+// process_count gauges until ctx is cancelled. The min/max gauges cover the
+// last window samples.
+func sampleProcessCount(ctx context.Context, interval time.Duration, window int) {
+	samples := make([]int, 0, window)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		processes, err := listProcesses(ctx)
+		if err != nil {
+			log.Printf("ps.Processes(): %v", err)
+		} else {
+			if len(samples) == window {
+				copy(samples, samples[1:])
+				samples = samples[:window-1]
+			}
+			samples = append(samples, len(processes))
+
+			min, max := samples[0], samples[0]
+			for _, n := range samples[1:] {
+				if n < min {
+					min = n
+				}
+				if n > max {
+					max = n
+				}
+			}
+			processCount.Set(float64(len(processes)))
+			processCountMin.Set(float64(min))
+			processCountMax.Set(float64(max))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
@@ -119,59 +758,279 @@ func getTimestamp() string {
 }
 
 func getOnelineLog(r *http.Request) string {
-	logstr := fmt.Sprintf("%s Hello, World: Host=%s, LocalAddr=%s, RemoteAddr=%s", getTimestamp(), r.Host, getLocalIP(), r.RemoteAddr)
-	fwdAddr := r.Header.Get("X-Forwarded-For")
-	if fwdAddr != "" {
-		logstr = fmt.Sprintf("%s, X-Forwarded-For=%s", logstr, fwdAddr)
+	return fmt.Sprintf("%s %s", getTimestamp(), getOnelineInfo(r))
+}
+
+// displayHost returns the request's Host header, or "<none>" when the
+// client sent none.
+func displayHost(r *http.Request) string {
+	if r.Host == "" {
+		return "<none>"
+	}
+	return r.Host
+}
+
+// getOnelineInfo is getOnelineLog without the timestamp, for use with
+// loggers that add their own.
+func getOnelineInfo(r *http.Request) string {
+	logstr := fmt.Sprintf("Hello, World: Host=%s, LocalAddr=%s, RemoteAddr=%s", displayHost(r), getLocalIP(), r.RemoteAddr)
+	if hops := forwardedForHops(r); len(hops) > 0 {
+		logstr = fmt.Sprintf("%s, X-Forwarded-For=%s", logstr, strings.Join(hops, ","))
 	}
 	return logstr
 }
 
-func doHelloHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("%s <helloHandler>\n", getOnelineLog(r))
-	fmt.Fprintf(os.Stderr, "(STDERR) %s <helloHandler>\n", getOnelineLog(r))
-	h := r.Header
-	keys := make([]string, len(h))
-	i := 0
+// helloInfo is the data reported by doHelloHandler. Fields whose lookup
+// failed are left empty and Degraded is set.
+type helloInfo struct {
+	Greeting       string              `json:"greeting" yaml:"greeting"`
+	Timestamp      string              `json:"timestamp" yaml:"timestamp"`
+	Hostname       string              `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+	LocalAddress   string              `json:"local_address,omitempty" yaml:"local_address,omitempty"`
+	Gateway        string              `json:"gateway,omitempty" yaml:"gateway,omitempty"`
+	RoutableAddr   string              `json:"routable_address,omitempty" yaml:"routable_address,omitempty"`
+	Headers        map[string][]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	HeadersOmitted int                 `json:"headers_omitted,omitempty" yaml:"headers_omitted,omitempty"`
+	Host           string              `json:"host,omitempty" yaml:"host,omitempty"`
+	RemoteAddress  string              `json:"remote_address,omitempty" yaml:"remote_address,omitempty"`
+	ClientAddress  string              `json:"client_address,omitempty" yaml:"client_address,omitempty"`
+	ForwardedProto string              `json:"forwarded_proto,omitempty" yaml:"forwarded_proto,omitempty"`
+	ForwardedHost  string              `json:"forwarded_host,omitempty" yaml:"forwarded_host,omitempty"`
+	Degraded       bool                `json:"degraded,omitempty" yaml:"degraded,omitempty"`
+	// RequestsTotal is http_requests_total when HelloRequestCount is set.
+	RequestsTotal *int64 `json:"requests_total,omitempty" yaml:"requests_total,omitempty"`
+	// Timings are the microseconds each lookup took, reported with
+	// ?timings=true.
+	Timings map[string]int64 `json:"timings_us,omitempty" yaml:"timings_us,omitempty"`
+}
+
+var helloTemplate = template.Must(template.New("hello").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Greeting}}</title></head>
+<body>
+<h1>{{.Greeting}}</h1>
+<ul>
+<li>Timestamp: {{.Timestamp}}</li>
+{{- if .Hostname}}
+<li>Hostname: {{.Hostname}}</li>
+{{- end}}
+{{- if .LocalAddress}}
+<li>LocalAddress: {{.LocalAddress}}</li>
+{{- end}}
+{{- if .Gateway}}
+<li>Gateway: {{.Gateway}}</li>
+{{- end}}
+{{- if .RoutableAddr}}
+<li>RoutableAddress: {{.RoutableAddr}}</li>
+{{- end}}
+<li>Headers:<ul>
+{{- range $k, $v := .Headers}}
+<li>{{$k}}: {{$v}}</li>
+{{- end}}
+{{- if .HeadersOmitted}}
+<li>... {{.HeadersOmitted}} more</li>
+{{- end}}
+</ul></li>
+<li>Host: {{.Host}}</li>
+<li>RemoteAddress: {{.RemoteAddress}}</li>
+<li>ClientAddress: {{.ClientAddress}}</li>
+{{- if .ForwardedProto}}
+<li>ForwardedProto: {{.ForwardedProto}}</li>
+{{- end}}
+{{- if .ForwardedHost}}
+<li>ForwardedHost: {{.ForwardedHost}}</li>
+{{- end}}
+{{- if .RequestsTotal}}
+<li>RequestsTotal: {{.RequestsTotal}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+// hostGreeting returns the greeting configured for the request's Host,
+// ignoring any port, or defaultGreeting.
+func hostGreeting(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if greeting, ok := currentConfig().HostGreetings[strings.ToLower(host)]; ok {
+		return greeting
+	}
+	return defaultGreeting()
+}
+
+// capHeaders returns the first max header names of h in sorted order,
+// and how many were left out, to bound the work and output of endpoints
+// that echo request headers back.
+func capHeaders(h http.Header, max int) (map[string][]string, int) {
+	if len(h) <= max {
+		return h, 0
+	}
+	keys := make([]string, 0, len(h))
 	for k := range h {
-		keys[i] = k
-		i++
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	capped := make(map[string][]string, max)
+	for _, k := range keys[:max] {
+		capped[k] = h[k]
+	}
+	return capped, len(h) - max
+}
 
-	//fmt.Println(keys)
-	fmt.Fprintln(w, "Hello, World!")
+// getHelloInfo gathers the hello data. Each lookup is independent, so a
+// failing one only leaves its own fields empty.
+func getHelloInfo(r *http.Request) helloInfo {
+	info := helloInfo{
+		Greeting:      hostGreeting(r),
+		Timestamp:     getTimestamp(),
+		Host:          displayHost(r),
+		RemoteAddress: r.RemoteAddr,
+	}
+	info.Headers, info.HeadersOmitted = capHeaders(r.Header, currentConfig().MaxRenderedHeaders)
+	info.ClientAddress, _ = getClientIP(r)
+	if fwd, ok := getForwarded(r); ok {
+		info.ForwardedProto = fwd.Proto
+		info.ForwardedHost = fwd.Host
+	}
+
+	info.Timings = map[string]int64{}
+	lap := time.Now()
+	elapsed := func(step string) {
+		now := time.Now()
+		info.Timings[step] = now.Sub(lap).Microseconds()
+		lap = now
+	}
 
 	hostname, err := os.Hostname()
 	if err != nil {
-		fmt.Printf("os.Hostname(): %v\n", err)
-		return
+		handlerError(r, errKindHostname, "os.Hostname()", err)
+		info.Degraded = true
 	}
-	fmt.Fprintf(w, "  Timestamp: %s\n", getTimestamp())
-	fmt.Fprintf(w, "  Hostname: %s\n", hostname)
-	fmt.Fprintf(w, "  LocalAddress: %s\n", getLocalIP())
+	info.Hostname = hostname
+	elapsed("hostname")
 
-	gw, err := gateway.DiscoverGateway()
+	info.LocalAddress = getLocalIP()
+	if info.LocalAddress == "" {
+		info.Degraded = true
+	}
+	elapsed("local_address")
+
+	gw, err := discoverGateway()
+	elapsed("gateway")
 	if err != nil {
-		fmt.Printf("gateway.DiscoverGateway(): %v\n", err)
-		return
+		handlerError(r, errKindGateway, "gateway.DiscoverGateway()", err)
+		info.Degraded = true
+	} else if noGateway(gw) {
+		info.Gateway = "none"
+	} else {
+		info.Gateway = gw.String()
+		info.RoutableAddr = getRoutableIP(gw)
+		elapsed("routable_address")
 	}
-	fmt.Fprintf(w, "  Gateway: %s\n", gw.String())
+	return info
+}
 
-	fmt.Fprintln(w, "  Headers:")
+func writeHelloText(w http.ResponseWriter, info helloInfo) {
+	fmt.Fprintln(w, info.Greeting)
+	fmt.Fprintf(w, "  Timestamp: %s\n", info.Timestamp)
+	if info.Hostname != "" {
+		fmt.Fprintf(w, "  Hostname: %s\n", info.Hostname)
+	}
+	if info.LocalAddress != "" {
+		fmt.Fprintf(w, "  LocalAddress: %s\n", info.LocalAddress)
+	}
+	if info.Gateway != "" {
+		fmt.Fprintf(w, "  Gateway: %s\n", info.Gateway)
+	}
+	if info.RoutableAddr != "" {
+		fmt.Fprintf(w, "  RoutableAddress: %s\n", info.RoutableAddr)
+	}
 
+	fmt.Fprintln(w, "  Headers:")
+	keys := make([]string, 0, len(info.Headers))
+	for k := range info.Headers {
+		keys = append(keys, k)
+	}
 	sort.Strings(keys)
 	for _, k := range keys {
-		fmt.Fprintf(w, "    %s: %s\n", k, h[k])
+		fmt.Fprintf(w, "    %s: %s\n", k, info.Headers[k])
+	}
+	if info.HeadersOmitted > 0 {
+		fmt.Fprintf(w, "    ... %d more\n", info.HeadersOmitted)
+	}
+
+	fmt.Fprintf(w, "  Host: %s\n", info.Host)
+	fmt.Fprintf(w, "  RemoteAddress: %s\n", info.RemoteAddress)
+	fmt.Fprintf(w, "  ClientAddress: %s\n", info.ClientAddress)
+	if info.ForwardedProto != "" {
+		fmt.Fprintf(w, "  ForwardedProto: %s\n", info.ForwardedProto)
+	}
+	if info.ForwardedHost != "" {
+		fmt.Fprintf(w, "  ForwardedHost: %s\n", info.ForwardedHost)
+	}
+	if info.RequestsTotal != nil {
+		fmt.Fprintf(w, "  RequestsTotal: %d\n", *info.RequestsTotal)
+	}
+}
+
+func doHelloHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <helloHandler>", getOnelineInfo(r))
+	fmt.Fprintf(os.Stderr, "(STDERR) %s <helloHandler>\n", getOnelineLog(r))
+
+	if !checkQuery(w, r) {
+		return
 	}
 
-	fmt.Fprintf(w, "  Host: %s\n", r.Host)
-	fmt.Fprintf(w, "  RemoteAddress: %s\n", r.RemoteAddr)
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "text", "json", "html", "yaml":
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q: must be text, json, html or yaml", format), http.StatusBadRequest)
+		return
+	}
+
+	info := getHelloInfo(r)
+	if r.URL.Query().Get("timings") != "true" {
+		info.Timings = nil
+	}
+	if currentConfig().HelloRequestCount {
+		if n, err := counterValue(httpReqs); err != nil {
+			handlerError(r, errKindMetrics, "counterValue()", err)
+		} else {
+			total := int64(n)
+			info.RequestsTotal = &total
+		}
+	}
+	helloResponses.Inc()
+	if info.Degraded {
+		helloDegraded.Inc()
+		w.Header().Set("X-Degraded", "true")
+	}
+	switch format {
+	case "json":
+		writeJSON(w, r, http.StatusOK, info)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := helloTemplate.Execute(w, info); err != nil {
+			handlerError(r, errKindEncode, "helloTemplate.Execute()", err)
+		}
+	case "yaml":
+		w.Header().Set("Content-Type", "application/yaml")
+		if err := yaml.NewEncoder(w).Encode(info); err != nil {
+			handlerError(r, errKindEncode, "yaml.Encode()", err)
+		}
+	default:
+		writeHelloText(w, info)
+	}
 
 	httpReqs.Inc()
 }
 
 func onelineHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("%s <onelineHandler>\n", getOnelineLog(r))
+	logFromCtx(r.Context()).Printf("%s <onelineHandler>", getOnelineInfo(r))
 	fmt.Fprintf(os.Stderr, "(STDERR) %s <onelineHandler>\n", getOnelineLog(r))
 	fmt.Fprintf(w, "%s\n", getOnelineLog(r))
 
@@ -179,22 +1038,191 @@ func onelineHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func versionHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("%s <versionHandler>\n", getOnelineLog(r))
+	logFromCtx(r.Context()).Printf("%s <versionHandler>", getOnelineInfo(r))
 	fmt.Fprintf(w, "%s\n", version)
+	if currentConfig().VersionModule {
+		if path, modVersion, ok := mainModule(); ok {
+			fmt.Fprintf(w, "module %s %s\n", path, modVersion)
+		}
+	}
 
 	httpReqs.Inc()
 }
 
+// develVersion is the main module version the go command records for
+// builds from a local checkout rather than a tagged module.
+const develVersion = "(devel)"
+
+// mainModule returns the path and version of the main module from the
+// build info. The version is develVersion for local builds, and ok is
+// false when the binary was built without module support.
+func mainModule() (path, modVersion string, ok bool) {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok || bi.Main.Path == "" {
+		return "", "", false
+	}
+	modVersion = bi.Main.Version
+	if modVersion == "" {
+		modVersion = develVersion
+	}
+	return bi.Main.Path, modVersion, true
+}
+
+type moduleVersion struct {
+	Path    string `json:"path"`
+	Version string `json:"version"`
+	Sum     string `json:"sum,omitempty"`
+	Replace string `json:"replace,omitempty"`
+}
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Module    string `json:"module,omitempty"`
+	// ModuleVersion is the main module's version, develVersion for a
+	// local build. It is unrelated to Version, which is set by hand.
+	ModuleVersion string          `json:"module_version,omitempty"`
+	Devel         bool            `json:"devel,omitempty"`
+	Deps          []moduleVersion `json:"deps"`
+	// Error explains an empty Deps when the binary carries no build info,
+	// e.g. when built without module support.
+	Error string `json:"error,omitempty"`
+}
+
+// versionJSONHandler serves /version/json: the app version and the module
+// dependencies compiled into the binary, as reported by
+// debug.ReadBuildInfo.
+func versionJSONHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <versionJSONHandler>", getOnelineInfo(r))
+
+	info := versionInfo{Version: version, GoVersion: runtime.Version(), Deps: []moduleVersion{}}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		info.Error = "build info not available"
+	} else {
+		info.Module, info.ModuleVersion, _ = mainModule()
+		info.Devel = info.ModuleVersion == develVersion
+		for _, dep := range bi.Deps {
+			mv := moduleVersion{Path: dep.Path, Version: dep.Version, Sum: dep.Sum}
+			if dep.Replace != nil {
+				mv.Replace = dep.Replace.Path + "@" + dep.Replace.Version
+			}
+			info.Deps = append(info.Deps, mv)
+		}
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
+
+type nowInfo struct {
+	Wall          string  `json:"wall"`
+	UnixNanos     int64   `json:"unix_nanos"`
+	Uptime        string  `json:"uptime"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Timezone      string  `json:"timezone"`
+	UTCOffset     int     `json:"utc_offset_seconds"`
+}
+
+func nowHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <nowHandler>", getOnelineInfo(r))
+
+	now := time.Now()
+	zone, offset := now.Zone()
+	uptime := now.Sub(startTime)
+	writeJSON(w, r, http.StatusOK, nowInfo{
+		Wall:          now.Format(time.RFC3339Nano),
+		UnixNanos:     now.UnixNano(),
+		Uptime:        uptime.String(),
+		UptimeSeconds: uptime.Seconds(),
+		Timezone:      zone,
+		UTCOffset:     offset,
+	})
+
+	httpReqs.Inc()
+}
+
+func colorHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <colorHandler>", getOnelineInfo(r))
+	fmt.Fprintf(w, "%s\n", currentConfig().AppColor)
+
+	httpReqs.Inc()
+}
+
+type psEntry struct {
+	PID        int      `json:"pid"`
+	Executable string   `json:"executable"`
+	Args       []string `json:"args"`
+}
+
+type psInfo struct {
+	Processes []psEntry `json:"processes"`
+	// Partial is set when the enumeration failed part way; Error says why.
+	Partial bool   `json:"partial,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// psHandler lists the processes, as text or with ?format=json. When the
+// enumeration fails part way, the processes found are listed followed by
+// a warning, or marked partial in JSON.
 func psHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("%s <psHandler>\n", getOnelineLog(r))
+	logFromCtx(r.Context()).Printf("%s <psHandler>", getOnelineInfo(r))
 
-	processes, err := ps.Processes()
+	if !checkQuery(w, r) {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "text" && format != "json" {
+		http.Error(w, fmt.Sprintf("unknown format %q: must be text or json", format), http.StatusBadRequest)
+		return
+	}
+	if !hasProcFS {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+	processes, err := listProcesses(r.Context())
+	if err == errProcessListBusy {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
-		fmt.Fprintf(w, "ps.Processes(): %v\n", err)
+		handlerError(r, errKindProcessList, "ps.Processes()", err)
 	}
-	for _, p := range processes {
-		fmt.Fprintf(w, "* %s\t%s\n", p.Executable(), getProcCmdArgs(p.(*ps.UnixProcess)))
+	if format == "json" {
+		info := psInfo{Processes: make([]psEntry, len(processes))}
+		for i, p := range processes {
+			info.Processes[i] = psEntry{PID: p.Pid(), Executable: p.Executable(), Args: getProcCmdArgs(p)}
+		}
+		code := http.StatusOK
+		if err != nil {
+			info.Error = err.Error()
+			info.Partial = len(processes) > 0
+			if !info.Partial {
+				code = http.StatusInternalServerError
+			}
+		}
+		writeJSON(w, r, code, info)
+	} else {
+		printProcesses(w, processes, err)
 	}
 
 	httpReqs.Inc()
 }
+
+// printProcesses prints processes as psHandler's text format. If the
+// enumeration failed, err is printed instead or, when some processes were
+// found anyway, after them as a warning that the list is partial.
+func printProcesses(w io.Writer, processes []ps.Process, err error) {
+	if err != nil && len(processes) == 0 {
+		fmt.Fprintf(w, "ps.Processes(): %v\n", err)
+		return
+	}
+	for _, p := range processes {
+		fmt.Fprintf(w, "* %s\t%s\n", p.Executable(), getProcCmdArgs(p))
+	}
+	if err != nil {
+		fmt.Fprintf(w, "WARNING: partial process list, %d processes listed: ps.Processes(): %v\n", len(processes), err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNoGateway(t *testing.T) {
+	tests := []struct {
+		name string
+		gw   net.IP
+		want bool
+	}{
+		{"nil", nil, true},
+		{"unspecified", net.IPv4zero, true},
+		{"unspecified v6", net.IPv6unspecified, true},
+		{"address", net.ParseIP("192.168.1.1"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := noGateway(tt.gw); got != tt.want {
+				t.Errorf("noGateway(%v) = %v, want %v", tt.gw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickLocalIP(t *testing.T) {
+	linkLocal := localAddr{ip: net.ParseIP("fe80::1"), zone: "eth0"}
+	tests := []struct {
+		name             string
+		addrs            []localAddr
+		includeLinkLocal bool
+		want             string
+	}{
+		{"none", nil, true, ""},
+		{"loopback only", []localAddr{{ip: net.ParseIP("127.0.0.1"), zone: "lo"}, {ip: net.IPv6loopback, zone: "lo"}}, true, ""},
+		{"ipv4 first", []localAddr{linkLocal, {ip: net.ParseIP("2001:db8::1"), zone: "eth0"}, {ip: net.ParseIP("10.0.0.1"), zone: "eth0"}}, true, "10.0.0.1"},
+		{"global ipv6 without zone", []localAddr{linkLocal, {ip: net.ParseIP("2001:db8::1"), zone: "eth0"}}, true, "2001:db8::1"},
+		{"link-local with zone", []localAddr{linkLocal}, true, "fe80::1%eth0"},
+		{"link-local without zone", []localAddr{{ip: net.ParseIP("fe80::1")}}, true, "fe80::1"},
+		{"link-local excluded", []localAddr{linkLocal}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickLocalIP(tt.addrs, tt.includeLinkLocal); got != tt.want {
+				t.Errorf("pickLocalIP(%v, %v) = %q, want %q", tt.addrs, tt.includeLinkLocal, got, tt.want)
+			}
+		})
+	}
+}
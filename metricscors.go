@@ -0,0 +1,42 @@
+package main
+
+import "net/http"
+
+// metricsCORSAllowed reports whether origin is listed in
+// MetricsCORSOrigins, where "*" allows any origin.
+func metricsCORSAllowed(c *Config, origin string) bool {
+	for _, o := range c.MetricsCORSOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// withMetricsCORS answers OPTIONS on the metrics endpoint itself, with the
+// allowed methods and, for origins in MetricsCORSOrigins, the CORS
+// preflight headers, instead of serving the metrics. Preflights carry no
+// credentials, so it wraps withMetricsAuth. Other requests from allowed
+// origins get Access-Control-Allow-Origin on the response.
+func withMetricsCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		if origin != "" && metricsCORSAllowed(c, origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			if r.Method == http.MethodOptions {
+				h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+				h.Set("Access-Control-Allow-Headers", "Authorization, Accept")
+				h.Set("Access-Control-Max-Age", "600")
+			}
+		}
+		if r.Method == http.MethodOptions {
+			h.Set("Allow", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"net/http"
+)
+
+// metricsPath is where metrics are served on the app port.
+const metricsPath = "/metrics"
+
+// withMetricsPath serves metricsPath from metrics and everything else from
+// app. Metrics requests skip the app middleware, as they do on the
+// metrics port.
+func withMetricsPath(metrics, app http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metricsPath {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		app.ServeHTTP(w, r)
+	})
+}
+
+// logMetricsOnAppPort explains at startup why metrics are served on the
+// app port and what that exposes.
+func logMetricsOnAppPort(c *Config) {
+	switch {
+	case c.MetricsOnAppPort && c.metricsPortSet && c.MetricsPort != c.AppPort:
+		log.Printf("METRICS_ON_APP_PORT is set, ignoring METRICS_PORT=%d", c.MetricsPort)
+	case !c.MetricsOnAppPort:
+		log.Printf("APP_PORT and METRICS_PORT are both %d, serving metrics on the app port", c.AppPort)
+	}
+	log.Printf("serving metrics at: %s%s", appAddr, metricsPath)
+	if c.MetricsToken == "" && c.MetricsUser == "" {
+		log.Printf("WARNING: metrics are served on the app port without METRICS_TOKEN or METRICS_USER, and can be read wherever the app is exposed")
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type ctxKey int
+
+// Reasons used for the http_requests_rejected_total "reason" label. The set
+// is fixed so the metric's cardinality stays bounded.
+const (
+	rejectBodyTooLarge     = "body_too_large"
+	rejectURLTooLong       = "url_too_long"
+	rejectRateLimited      = "rate_limited"
+	rejectUnauthorized     = "unauthorized"
+	rejectMethodNotAllowed = "method_not_allowed"
+	rejectHostNotAllowed   = "host_not_allowed"
+	rejectOverloaded       = "overloaded"
+	rejectUpgrade          = "upgrade_not_allowed"
+	rejectWarmingUp        = "warming_up"
+	rejectFetchDenied      = "fetch_denied"
+	rejectMissingHost      = "missing_host"
+	rejectQueryTooLarge    = "query_too_large"
+)
+
+var rejectReasons = []string{
+	rejectBodyTooLarge,
+	rejectURLTooLong,
+	rejectRateLimited,
+	rejectUnauthorized,
+	rejectMethodNotAllowed,
+	rejectHostNotAllowed,
+	rejectOverloaded,
+	rejectUpgrade,
+	rejectWarmingUp,
+	rejectFetchDenied,
+	rejectMissingHost,
+	rejectQueryTooLarge,
+}
+
+const (
+	loggerKey ctxKey = iota
+	routeKey
+	handlerTimeKey
+	routeSlotKey
+)
+
+// defaultLogger is returned by logFromCtx when no request logger is set.
+var defaultLogger = log.New(logOutput, "", log.LstdFlags)
+
+// statusWriter records the status code and body size written by a handler.
+// When timing is set, it adds X-Response-Time-Ms, measured from start, just
+// before the headers are sent.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+	start       time.Time
+	timing      bool
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.wroteHeader {
+		return
+	}
+	sw.wroteHeader = true
+	sw.status = code
+	if sw.timing {
+		ms := float64(time.Since(sw.start)) / float64(time.Millisecond)
+		sw.Header().Set("X-Response-Time-Ms", strconv.FormatFloat(ms, 'f', 3, 64))
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if !sw.wroteHeader {
+		// Sniff the content type here, as net/http would, so that it
+		// is visible in Header() for the access log.
+		h := sw.Header()
+		if _, ok := h["Content-Type"]; !ok && h.Get("Content-Encoding") == "" && len(b) > 0 {
+			h.Set("Content-Type", http.DetectContentType(b))
+		}
+		sw.WriteHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += n
+	return n, err
+}
+
+// Flush passes flushes through, so streaming handlers work behind the
+// access log.
+func (sw *statusWriter) Flush() {
+	if !sw.wroteHeader {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// maxRequestIDLength bounds client-supplied X-Request-ID values.
+const maxRequestIDLength = 128
+
+// validRequestID reports whether id is safe to echo in headers and logs:
+// non-empty, at most maxRequestIDLength bytes, and made only of letters,
+// digits and "-_.:".
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// getTraceID returns the trace ID from a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or "" if there is none.
+func getTraceID(r *http.Request) string {
+	parts := strings.Split(r.Header.Get("traceparent"), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 {
+		return ""
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return ""
+	}
+	return parts[1]
+}
+
+// logFromCtx returns the request-scoped logger seeded by withAccessLog, so
+// that handler log lines carry the request and trace IDs.
+func logFromCtx(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*log.Logger); ok {
+		return logger
+	}
+	return defaultLogger
+}
+
+// inFlight counts requests currently being handled by the app server.
+var inFlight int64
+
+func inFlightRequests() int64 {
+	return atomic.LoadInt64(&inFlight)
+}
+
+// withInFlight tracks the number of requests being handled.
+func withInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&inFlight, 1)
+		requestsInFlight.Inc()
+		defer func() {
+			atomic.AddInt64(&inFlight, -1)
+			requestsInFlight.Dec()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// knownMethods are the methods that get their own label value in
+// http_requests_by_method_total; anything else is counted as "OTHER" so a
+// client cannot grow the metric with made-up methods.
+var knownMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// normalizeMethod maps method to one of knownMethods or "OTHER".
+func normalizeMethod(method string) string {
+	for _, m := range knownMethods {
+		if method == m {
+			return m
+		}
+	}
+	return "OTHER"
+}
+
+// withMethodCount counts every request in http_requests_by_method_total
+// and http_requests_by_scheme_total.
+func withMethodCount(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestsByMethod.WithLabelValues(normalizeMethod(r.Method)).Inc()
+		requestsByScheme.WithLabelValues(getScheme(r)).Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// traceAllow is the Allow header sent when TRACE is rejected: the methods
+// some route answers.
+const traceAllow = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// withTraceMethod rejects TRACE requests to every route with 405 unless
+// AllowTrace is set, as echoing a request back can disclose cookies and
+// credentials to scripts (cross-site tracing).
+func withTraceMethod(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodTrace && !currentConfig().AllowTrace {
+			w.Header().Set("Allow", traceAllow)
+			rejectRequest(w, rejectMethodNotAllowed, http.StatusMethodNotAllowed, "TRACE not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withMaxURLLength rejects requests whose URL is longer than the configured
+// MaxURLLength with 414 Request-URI Too Long.
+func withMaxURLLength(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.String()) > currentConfig().MaxURLLength {
+			rejectRequest(w, rejectURLTooLong, http.StatusRequestURITooLong, http.StatusText(http.StatusRequestURITooLong))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rejectRequest replies with code and msg and counts the rejection under
+// reason, which must be one of rejectReasons.
+func rejectRequest(w http.ResponseWriter, reason string, code int, msg string) {
+	requestsRejected.WithLabelValues(reason).Inc()
+	http.Error(w, msg, code)
+}
+
+// hostAllowed reports whether host (a Host header value, possibly with a
+// port) matches one of the allowed patterns.
+func hostAllowed(host string, allowed []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "*.") {
+			if strings.HasSuffix(host, pattern[1:]) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// withAllowedHosts rejects requests whose Host header is not listed in
+// the configured AllowedHosts with 400 Bad Request. All hosts pass when
+// the list is empty. Requests without a Host header are left to
+// MissingHost.
+func withAllowedHosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		if r.Host == "" {
+			if c.MissingHost == missingHostReject {
+				rejectRequest(w, rejectMissingHost, http.StatusBadRequest, "missing Host header")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := c.AllowedHosts
+		if len(allowed) > 0 && !hostAllowed(r.Host, allowed) {
+			rejectRequest(w, rejectHostNotAllowed, http.StatusBadRequest, "host not allowed")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withAppColor sets X-App-Color on every response when AppColor is configured.
+func withAppColor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if color := currentConfig().AppColor; color != "" {
+			w.Header().Set("X-App-Color", color)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withInstanceStart sets X-Instance-Start on every response to startTime,
+// formatted as InstanceStartHeader says, unless it is off.
+func withInstanceStart(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch currentConfig().InstanceStartHeader {
+		case instanceStartRFC3339:
+			w.Header().Set("X-Instance-Start", startTime.UTC().Format(time.RFC3339))
+		case instanceStartUnix:
+			w.Header().Set("X-Instance-Start", strconv.FormatInt(startTime.Unix(), 10))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withALPN sets X-ALPN to the protocol negotiated via ALPN when ALPNHeader
+// is set. Plain-text requests, and TLS clients that offered no ALPN, get
+// none.
+func withALPN(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().ALPNHeader && r.TLS != nil && r.TLS.NegotiatedProtocol != "" {
+			w.Header().Set("X-ALPN", r.TLS.NegotiatedProtocol)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hopByHopHeaders apply to a single connection and are never copied by
+// withPropagateHeaders.
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// withPropagateHeaders copies the request headers listed in
+// PropagateHeaders into the response, skipping any that the request's
+// Connection header marks as hop-by-hop.
+func withPropagateHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		names := currentConfig().PropagateHeaders
+		if len(names) > 0 {
+			hop := connectionTokens(r.Header)
+			for _, name := range names {
+				if values, ok := r.Header[name]; ok && !hop[name] {
+					w.Header()[name] = append([]string(nil), values...)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// connectionTokens returns the header names listed in h's Connection
+// header, canonicalized.
+func connectionTokens(h http.Header) map[string]bool {
+	tokens := map[string]bool{}
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			tokens[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	return tokens
+}
+
+// upgradeRoutes are the only routes that may switch protocols.
+var upgradeRoutes = map[string]bool{
+	"/ws/echo": true,
+}
+
+// withUpgradePolicy rejects protocol upgrade requests ("Connection:
+// Upgrade" with an Upgrade header) to any route outside upgradeRoutes,
+// with the configured UpgradeRejectStatus. net/http would otherwise hand
+// them to a handler that answers as if no upgrade had been asked for.
+func withUpgradePolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" && connectionTokens(r.Header)["Upgrade"] && !upgradeRoutes[r.URL.Path] {
+			w.Header().Set("Connection", "close")
+			rejectRequest(w, rejectUpgrade, currentConfig().UpgradeRejectStatus, "protocol upgrade not supported on this route")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// probePaths are the readiness probes, which keep answering while the
+// app is warming up.
+var probePaths = map[string]bool{
+	"/readyz":      true,
+	"/ready/ports": true,
+}
+
+// withForceHTTPS redirects requests that a trusted proxy says arrived
+// over plain http to the same URL on https, with 308 so the method and
+// body are kept, when ForceHTTPS is set. Probes are served as they come,
+// as kubelets and load balancers check them on the pod directly. The
+// redirect uses the Host header without its port, answering 400 unless it
+// is a plain host name or address. Requests without that header, such as
+// direct plain http ones, are served as they come.
+func withForceHTTPS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto, ok := forwardedProto(r)
+		if !currentConfig().ForceHTTPS || probePaths[r.URL.Path] || !ok || proto != "http" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !validRedirectHost(host) {
+			http.Error(w, "invalid Host header", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
+
+// validRedirectHost reports whether host, without a port, is an IP
+// address or a DNS name, so that it cannot smuggle a path, user info or a
+// different authority into a redirect.
+func validRedirectHost(host string) bool {
+	host = strings.Trim(host, "[]")
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-' || ch == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// withWarmupGate answers 503 with Retry-After for everything but the
+// probes while warmup runs, if WarmupReject is set.
+func withWarmupGate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWarmingUp() && currentConfig().WarmupReject && !probePaths[r.URL.Path] {
+			w.Header().Set("Retry-After", "1")
+			rejectRequest(w, rejectWarmingUp, http.StatusServiceUnavailable, "warming up")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withConcurrencyLimit lets at most MaxConcurrentRequests requests run at
+// once. Others queue for up to RequestQueueTimeout and are then rejected
+// with 503; the time spent queueing is observed in
+// http_request_queue_wait_seconds. The limit is read when the handler is
+// built, so it does not change on reload.
+func withConcurrencyLimit(next http.Handler) http.Handler {
+	c := currentConfig()
+	if c.MaxConcurrentRequests <= 0 {
+		return next
+	}
+	slots := make(chan struct{}, c.MaxConcurrentRequests)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		select {
+		case slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(currentConfig().RequestQueueTimeout)
+			select {
+			case slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				requestQueueWait.Observe(time.Since(start).Seconds())
+				w.Header().Set("Retry-After", "1")
+				rejectRequest(w, rejectOverloaded, http.StatusServiceUnavailable, "server busy")
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				observeCancellation(r.Context(), r)
+				return
+			}
+		}
+		requestQueueWait.Observe(time.Since(start).Seconds())
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withPhaseTiming, the outermost middleware, splits each request's time
+// into the handler's share, measured by timeHandler around the routes, and
+// everything else, observing both in request_phase_duration_seconds.
+func withPhaseTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		var handlerTime time.Duration
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), handlerTimeKey, &handlerTime)))
+		total := time.Since(start)
+		requestPhaseDuration.WithLabelValues("middleware").Observe((total - handlerTime).Seconds())
+		if handlerTime > 0 {
+			requestPhaseDuration.WithLabelValues("handler").Observe(handlerTime.Seconds())
+		}
+	})
+}
+
+// timeHandler records how long next takes for withPhaseTiming.
+func timeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		if d, ok := r.Context().Value(handlerTimeKey).(*time.Duration); ok {
+			*d = time.Since(start)
+		}
+	})
+}
+
+// newAppHandler wraps the application routes in the middleware stack. The
+// first middleware listed is the outermost.
+func newAppHandler(routes http.Handler) http.Handler {
+	middleware := []func(http.Handler) http.Handler{
+		withPhaseTiming,
+		withInFlight,
+		withMethodCount,
+		withAccessLog,
+		withWarmupGate,
+		withConcurrencyLimit,
+		withCompression,
+		withAppColor,
+		withInstanceStart,
+		withALPN,
+		withPropagateHeaders,
+		withMaxURLLength,
+		withTraceMethod,
+		withUpgradePolicy,
+		withAllowedHosts,
+		withForceHTTPS,
+		withChaos,
+		withBodyOverrides,
+	}
+	h := timeHandler(routes)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want bool
+	}{
+		{"empty", "", false},
+		{"uuid", "0f8fad5b-d9cb-469f-a165-70867728950e", true},
+		{"allowed punctuation", "a_b.c:d-e", true},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"overlong", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"newline", "abc\ndef", false},
+		{"tab", "abc\tdef", false},
+		{"nul", "abc\x00", false},
+		{"space", "abc def", false},
+		{"non-ascii", "abcé", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := validRequestID(tt.id); got != tt.want {
+				t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a minimal token bucket limiter refilling at rate tokens
+// per second up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token if one is available at now. A change of rate, as on
+// a config reload, refills the bucket.
+func (b *tokenBucket) allow(rate float64, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rate != b.rate {
+		b.rate = rate
+		b.burst = math.Max(1, math.Ceil(rate))
+		b.tokens = b.burst
+		b.last = now
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// notFoundLimiter is shared by every unmatched path, however many clients
+// are probing them.
+var notFoundLimiter tokenBucket
+
+// notFound answers unmatched paths without running any handler or
+// diagnostics, since most of them come from scanners. Each is counted in
+// http_not_found_total; beyond NotFoundRateLimit per second they are
+// answered 429 instead.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	if !allowNotFound(w) {
+		return
+	}
+	notFoundResponses.Inc()
+	http.NotFound(w, r)
+}
+
+// strictRootFallback answers a path left unmatched under StrictRoot as
+// StrictRootFallback says, within the same rate limit as notFound.
+func strictRootFallback(w http.ResponseWriter, r *http.Request) {
+	switch currentConfig().StrictRootFallback {
+	case rootFallbackHint:
+		if !allowNotFound(w) {
+			return
+		}
+		notFoundResponses.Inc()
+		http.Error(w, "404 page not found; see /routes for the paths served here", http.StatusNotFound)
+	case rootFallbackRedirect:
+		if !allowNotFound(w) {
+			return
+		}
+		http.Redirect(w, r, "/", http.StatusFound)
+	default:
+		notFound(w, r)
+	}
+}
+
+// allowNotFound applies NotFoundRateLimit, answering 429 itself and
+// returning false when it is exceeded.
+func allowNotFound(w http.ResponseWriter) bool {
+	if rate := currentConfig().NotFoundRateLimit; rate > 0 && !notFoundLimiter.allow(rate, time.Now()) {
+		w.Header().Set("Retry-After", "1")
+		rejectRequest(w, rejectRateLimited, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+		return false
+	}
+	return true
+}
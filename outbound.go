@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// outboundJob is an outbound probe handed to the worker pool.
+type outboundJob struct {
+	fn   func()
+	done chan struct{}
+	// panicked holds what fn panicked with, if it did, so the panic can
+	// be raised again in the handler.
+	panicked interface{}
+}
+
+// outboundJobs feeds the MaxOutbound workers started by
+// runOutboundWorkers. It is unbuffered: a job is only sent once a worker
+// is free to take it.
+var outboundJobs = make(chan *outboundJob)
+
+// runOutboundWorkers runs n workers for the outbound probes of /fetch,
+// /ping/tcp and /selfupdate/check until ctx is cancelled, so that at most
+// n probes reach out of the pod at once however many requests ask.
+func runOutboundWorkers(ctx context.Context, n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-outboundJobs:
+					runOutboundJob(job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func runOutboundJob(job *outboundJob) {
+	outboundInFlight.Inc()
+	defer func() {
+		job.panicked = recover()
+		outboundInFlight.Dec()
+		close(job.done)
+	}()
+	job.fn()
+}
+
+// runOutbound runs fn on a worker from the outbound pool and waits for it
+// to finish. If no worker frees up before ctx is done, which for the
+// probes is their own timeout, it answers 503 itself and returns false
+// without running fn. Callers waiting for a worker are counted in
+// outbound_queue_depth.
+func runOutbound(ctx context.Context, w http.ResponseWriter, fn func()) bool {
+	job := &outboundJob{fn: fn, done: make(chan struct{})}
+	select {
+	case outboundJobs <- job:
+	default:
+		outboundQueued.Inc()
+		select {
+		case outboundJobs <- job:
+			outboundQueued.Dec()
+		case <-ctx.Done():
+			outboundQueued.Dec()
+			w.Header().Set("Retry-After", "1")
+			rejectRequest(w, rejectOverloaded, http.StatusServiceUnavailable, "too many outbound requests")
+			return false
+		}
+	}
+	<-job.done
+	if job.panicked != nil {
+		panic(fmt.Sprintf("outbound probe: %v", job.panicked))
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"runtime"
+)
+
+// errUnsupportedPlatform is returned by platform-specific lookups on
+// platforms that do not provide them, typically because they need Linux
+// /proc.
+var errUnsupportedPlatform = errors.New("not supported on this platform")
+
+// writeUnsupportedPlatform answers 501 for endpoints that are not
+// available on this platform, in the same shape everywhere.
+func writeUnsupportedPlatform(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusNotImplemented, map[string]string{
+		"error":    errUnsupportedPlatform.Error(),
+		"platform": runtime.GOOS + "/" + runtime.GOARCH,
+	})
+}
@@ -0,0 +1,5 @@
+package main
+
+// hasProcFS reports whether Linux /proc is available to the /proc-based
+// endpoints.
+const hasProcFS = true
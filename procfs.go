@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxProcFileSize bounds how much of a /proc file /proc/<pid>/<file> returns.
+const maxProcFileSize = 64 * 1024
+
+// procFiles are the /proc/<pid> entries /proc/<pid>/<file> may read.
+var procFiles = map[string]bool{
+	"status":  true,
+	"stat":    true,
+	"limits":  true,
+	"cmdline": true,
+	"environ": true,
+}
+
+// sensitiveNameParts mark environment variable names whose values are
+// redacted before being shown.
+var sensitiveNameParts = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+func isSensitiveName(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, part := range sensitiveNameParts {
+		if strings.Contains(upper, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactEnv replaces the value of sensitive KEY=VALUE entries.
+func redactEnv(env []string) []string {
+	out := make([]string, len(env))
+	for i, kv := range env {
+		if k := strings.SplitN(kv, "=", 2); len(k) == 2 && isSensitiveName(k[0]) {
+			kv = k[0] + "=<redacted>"
+		}
+		out[i] = kv
+	}
+	return out
+}
+
+// splitNulls splits NUL-separated /proc data such as cmdline and environ.
+func splitNulls(data []byte) []string {
+	return strings.Split(string(bytes.TrimRight(data, "\x00")), "\x00")
+}
+
+// readProcFile reads at most maxProcFileSize bytes of /proc/<pid>/<name>,
+// counting failures in proc_read_errors_total.
+func readProcFile(pid, name string) ([]byte, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%s/%s", pid, name))
+	if err != nil {
+		procReadErrors.WithLabelValues(name).Inc()
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxProcFileSize))
+	if err != nil {
+		procReadErrors.WithLabelValues(name).Inc()
+	}
+	return data, err
+}
+
+// procFileHandler serves /proc/<pid>/<file> for the files in procFiles,
+// where pid is numeric or "self". It is disabled unless ProcReader is set
+// and requires the admin token.
+func procFileHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <procFileHandler>", getOnelineInfo(r))
+
+	if !currentConfig().ProcReader {
+		http.NotFound(w, r)
+		return
+	}
+	if !requireToken(w, r) {
+		return
+	}
+	if !hasProcFS {
+		writeUnsupportedPlatform(w, r)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/proc/"), "/")
+	if len(parts) != 2 || !procFiles[parts[1]] {
+		http.Error(w, "expected /proc/<pid>/<status|stat|limits|cmdline|environ>", http.StatusBadRequest)
+		return
+	}
+	pid, name := parts[0], parts[1]
+	if _, err := strconv.Atoi(pid); err != nil && pid != "self" {
+		http.Error(w, "pid must be numeric or self", http.StatusBadRequest)
+		return
+	}
+
+	data, err := readProcFile(pid, name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch name {
+	case "cmdline":
+		fmt.Fprintf(w, "%s\n", strings.Join(splitNulls(data), " "))
+	case "environ":
+		for _, kv := range redactEnv(splitNulls(data)) {
+			fmt.Fprintln(w, kv)
+		}
+	default:
+		w.Write(data)
+	}
+
+	httpReqs.Inc()
+}
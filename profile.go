@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// profileCPUDuration is how long each periodic CPU profile runs.
+const profileCPUDuration = 10 * time.Second
+
+// runProfiler captures a CPU and a heap profile into dir every interval
+// until ctx is cancelled, keeping the newest keep files of each kind.
+func runProfiler(ctx context.Context, dir string, interval time.Duration, keep int) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("profiler: %v", err)
+		return
+	}
+	log.Printf("profiler: writing profiles to %s every %s", dir, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		stamp := time.Now().UTC().Format("20060102T150405Z")
+		if err := captureCPUProfile(ctx, filepath.Join(dir, "cpu-"+stamp+".pprof"), profileCPUDuration); err != nil {
+			log.Printf("profiler: cpu: %v", err)
+		}
+		if err := captureHeapProfile(filepath.Join(dir, "heap-"+stamp+".pprof")); err != nil {
+			log.Printf("profiler: heap: %v", err)
+		}
+		pruneProfiles(dir, "cpu-", keep)
+		pruneProfiles(dir, "heap-", keep)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// captureCPUProfile profiles for d, stopping early if ctx is cancelled.
+func captureCPUProfile(ctx context.Context, path string, d time.Duration) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := pprof.StartCPUProfile(f); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+	pprof.StopCPUProfile()
+	return nil
+}
+
+// runStartupProfile profiles the first d after boot into path, then hands
+// over to the periodic profiler if dir is set. Only one CPU profile can run
+// at a time, so the two share a goroutine.
+func runStartupProfile(ctx context.Context, path string, d time.Duration, dir string, interval time.Duration, keep int) {
+	log.Printf("profiler: writing startup CPU profile to %s for %s", path, d)
+	if err := captureCPUProfile(ctx, path, d); err != nil {
+		log.Printf("profiler: startup: %v", err)
+	} else {
+		log.Printf("profiler: startup CPU profile written to %s", path)
+	}
+	if dir != "" && ctx.Err() == nil {
+		runProfiler(ctx, dir, interval, keep)
+	}
+}
+
+func captureHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.WriteHeapProfile(f)
+}
+
+// pruneProfiles removes all but the newest keep files in dir starting with
+// prefix. File names embed a sortable timestamp.
+func pruneProfiles(dir, prefix string, keep int) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("profiler: %v", err)
+		return
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), prefix) && strings.HasSuffix(e.Name(), ".pprof") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			log.Printf("profiler: %v", err)
+		}
+		names = names[1:]
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/go-ps"
+	"golang.org/x/sync/singleflight"
+)
+
+// processList coalesces concurrent process enumerations and caches the
+// result for the configured PSCacheTTL, since ps.Processes walks all of
+// /proc.
+var processList struct {
+	group singleflight.Group
+
+	mu      sync.Mutex
+	cached  []ps.Process
+	expires time.Time
+}
+
+// psQueueTimeout is how long a caller waits for an enumeration slot before
+// giving up with errProcessListBusy.
+const psQueueTimeout = time.Second
+
+var errProcessListBusy = errors.New("too many concurrent process enumerations")
+
+// processSlots limits how many callers may be enumerating, or waiting on a
+// shared enumeration, at once. It is sized by initProcessSlots.
+var processSlots = make(chan struct{}, 2)
+
+// initProcessSlots sizes processSlots to n. It must be called before any
+// call to listProcesses.
+func initProcessSlots(n int) {
+	processSlots = make(chan struct{}, n)
+}
+
+// acquireProcessSlot takes a slot, queueing for at most psQueueTimeout.
+func acquireProcessSlot(ctx context.Context) error {
+	select {
+	case processSlots <- struct{}{}:
+		return nil
+	default:
+	}
+	psQueued.Inc()
+	defer psQueued.Dec()
+	timer := time.NewTimer(psQueueTimeout)
+	defer timer.Stop()
+	select {
+	case processSlots <- struct{}{}:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	psRejected.Inc()
+	return errProcessListBusy
+}
+
+// listProcesses returns the current process list. Concurrent callers share
+// a single enumeration, and a result younger than PSCacheTTL is reused.
+// Failed enumerations are not cached. Callers that need a fresh
+// enumeration take one of PSMaxConcurrent slots first, and get
+// errProcessListBusy if none frees up in time. Requests are counted in
+// ps_cache_hits_total, including those joining another's enumeration, or
+// ps_cache_misses_total.
+func listProcesses(ctx context.Context) ([]ps.Process, error) {
+	ttl := currentConfig().PSCacheTTL
+
+	processList.mu.Lock()
+	if ttl > 0 && time.Now().Before(processList.expires) {
+		cached := processList.cached
+		processList.mu.Unlock()
+		psCacheHits.Inc()
+		return cached, nil
+	}
+	processList.mu.Unlock()
+
+	if err := acquireProcessSlot(ctx); err != nil {
+		return nil, err
+	}
+	defer func() { <-processSlots }()
+
+	ran := false
+	v, err, _ := processList.group.Do("all", func() (interface{}, error) {
+		ran = true
+		processes, err := ps.Processes()
+		if err == nil && ttl > 0 {
+			processList.mu.Lock()
+			processList.cached = processes
+			processList.expires = time.Now().Add(ttl)
+			processList.mu.Unlock()
+		}
+		return processes, err
+	})
+	if ran {
+		psCacheMisses.Inc()
+	} else {
+		psCacheHits.Inc()
+	}
+	processes, _ := v.([]ps.Process)
+	return processes, err
+}
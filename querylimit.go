@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Default limits applied by checkQuery. They leave room for every handler's
+// parameters while bounding the work an abusive query string can cause.
+const (
+	defaultQueryMaxLength = 2048
+	defaultQueryMaxParams = 16
+	// base64QueryMaxLength is the default for /base64, whose data parameter
+	// may hold maxBase64Input bytes, up to three times that once
+	// percent-encoded.
+	base64QueryMaxLength = 3*maxBase64Input + defaultQueryMaxLength
+)
+
+// queryParamCount counts the parameters in a raw query string without
+// parsing it, so that an oversized one costs no more than a scan.
+func queryParamCount(rawQuery string) int {
+	n := 0
+	for _, part := range strings.FieldsFunc(rawQuery, func(r rune) bool { return r == '&' || r == ';' }) {
+		if part != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// queryLimitKey returns the key RouteQueryMaxLength and
+// RouteQueryMaxParams use for a route name: hyphens become underscores,
+// so that QUERY_MAX_LENGTH_ping_tcp is a valid environment variable name.
+func queryLimitKey(name string) string {
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// checkQuery is called by the handlers that take query parameters before
+// they read any. It answers 400 and returns false when the query string
+// is longer than QueryMaxLength or has more than QueryMaxParams
+// parameters, or the limits set for the route with
+// QUERY_MAX_LENGTH_<name> and QUERY_MAX_PARAMS_<name>.
+func checkQuery(w http.ResponseWriter, r *http.Request) bool {
+	c := currentConfig()
+	name := queryLimitKey(routeFromCtx(r.Context()).name)
+	maxLength, maxParams := c.QueryMaxLength, c.QueryMaxParams
+	if n, ok := c.RouteQueryMaxLength[name]; ok {
+		maxLength = n
+	}
+	if n, ok := c.RouteQueryMaxParams[name]; ok {
+		maxParams = n
+	}
+	if n := len(r.URL.RawQuery); n > maxLength {
+		rejectRequest(w, rejectQueryTooLarge, http.StatusBadRequest, fmt.Sprintf("query string too long: %d bytes, at most %d", n, maxLength))
+		return false
+	}
+	if n := queryParamCount(r.URL.RawQuery); n > maxParams {
+		rejectRequest(w, rejectQueryTooLarge, http.StatusBadRequest, fmt.Sprintf("too many query parameters: %d, at most %d", n, maxParams))
+		return false
+	}
+	return true
+}
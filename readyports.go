@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// portDialTimeout bounds each loopback dial made by /ready/ports.
+const portDialTimeout = 500 * time.Millisecond
+
+type portCheck struct {
+	Name  string `json:"name"`
+	Addr  string `json:"addr"`
+	Ready bool   `json:"ready"`
+	Error string `json:"error,omitempty"`
+}
+
+type portsReadiness struct {
+	Ready bool        `json:"ready"`
+	Ports []portCheck `json:"ports"`
+}
+
+// checkPort dials the port of listenAddr on loopback.
+func checkPort(name, listenAddr string) portCheck {
+	check := portCheck{Name: name}
+	_, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	check.Addr = net.JoinHostPort("127.0.0.1", port)
+	conn, err := net.DialTimeout("tcp", check.Addr, portDialTimeout)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	conn.Close()
+	check.Ready = true
+	return check
+}
+
+// checkListeners dials the app and metrics listeners concurrently. The
+// metrics listener is skipped when metrics share the app port.
+func checkListeners() portsReadiness {
+	listeners := []struct{ name, addr string }{
+		{"app", appAddr},
+	}
+	if metricsAddr != appAddr {
+		listeners = append(listeners, struct{ name, addr string }{"metrics", metricsAddr})
+	}
+	info := portsReadiness{Ready: true, Ports: make([]portCheck, len(listeners))}
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func(i int, name, addr string) {
+			defer wg.Done()
+			info.Ports[i] = checkPort(name, addr)
+		}(i, l.name, l.addr)
+	}
+	wg.Wait()
+	for _, p := range info.Ports {
+		if !p.Ready {
+			info.Ready = false
+		}
+	}
+	return info
+}
+
+// readyPortsHandler dials the app and metrics listeners on loopback and
+// reports whether each accepts connections, answering 503 if any does not.
+func readyPortsHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <readyPortsHandler>", getOnelineInfo(r))
+
+	info := checkListeners()
+	code := http.StatusOK
+	if !info.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, code, info)
+
+	httpReqs.Inc()
+}
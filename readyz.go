@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessFirstCheck is how soon after startup the first readiness
+// check runs; later ones run every ReadinessInterval.
+const readinessFirstCheck = time.Second
+
+type readinessState struct {
+	Ready bool `json:"ready"`
+	// LastCheck is when the background check last ran, empty before the
+	// first run.
+	LastCheck           string          `json:"last_check,omitempty"`
+	LastResult          *portsReadiness `json:"last_result,omitempty"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	WarmingUp           bool            `json:"warming_up,omitempty"`
+}
+
+// readiness is the state kept by runReadinessChecks and served by /readyz.
+var readiness = struct {
+	sync.Mutex
+	state readinessState
+}{}
+
+// runReadinessChecks re-evaluates readiness in the background until ctx is
+// cancelled, so that /readyz stays cheap however often it is probed. The
+// instance becomes ready on the first passing check and unready after
+// threshold consecutive failures, or once shutdown starts.
+func runReadinessChecks(ctx context.Context, interval time.Duration, threshold int) {
+	timer := time.NewTimer(readinessFirstCheck)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			readiness.Lock()
+			readiness.state.Ready = false
+			readiness.Unlock()
+			return
+		case <-timer.C:
+		}
+		result := checkListeners()
+		readiness.Lock()
+		st := &readiness.state
+		st.LastCheck = time.Now().UTC().Format(time.RFC3339)
+		st.LastResult = &result
+		if result.Ready {
+			st.ConsecutiveFailures = 0
+			st.Ready = true
+		} else {
+			st.ConsecutiveFailures++
+			if st.Ready && st.ConsecutiveFailures >= threshold {
+				log.Printf("readiness: %d consecutive failed checks, marking not ready", st.ConsecutiveFailures)
+				st.Ready = false
+			}
+		}
+		readiness.Unlock()
+		timer.Reset(interval)
+	}
+}
+
+// readyzHandler answers 200 when the background readiness check considers
+// the instance ready and warmup is done, and 503 otherwise. With ?deep=1
+// it also reports the last check's time and result as JSON.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <readyzHandler>", getOnelineInfo(r))
+
+	readiness.Lock()
+	st := readiness.state
+	readiness.Unlock()
+	if isWarmingUp() {
+		st.Ready = false
+		st.WarmingUp = true
+	}
+
+	code := http.StatusOK
+	if !st.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	if r.URL.Query().Get("deep") != "" {
+		writeJSON(w, r, code, st)
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, http.StatusText(code))
+	}
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reapZombies waits for any exited child on every SIGCHLD until ctx is
+// cancelled. It is meant for running as PID 1, where orphaned processes
+// are re-parented to us; it would also reap children the app started
+// itself, so it must not be combined with exec.Cmd.Wait.
+func reapZombies(ctx context.Context) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+	defer signal.Stop(sigs)
+	log.Printf("running as PID 1, reaping zombie processes")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+		}
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if pid <= 0 || err != nil {
+				break
+			}
+			if currentConfig().LogLevel == logLevelDebug {
+				log.Printf("reaped child %d (%v)", pid, status)
+			}
+		}
+	}
+}
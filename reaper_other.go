@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"log"
+)
+
+func reapZombies(ctx context.Context) {
+	log.Printf("REAP_ZOMBIES: %v", errUnsupportedPlatform)
+}
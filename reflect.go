@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// maxReflectPath bounds the path echoed by /reflect/.
+	maxReflectPath = 2048
+	// maxReflectBody bounds the request body /reflect/ reads, and discards,
+	// to get at the trailers.
+	maxReflectBody = 1 << 20
+)
+
+// tlsVersions names the TLS versions reported by /reflect/.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// reflectConn describes the connection a request arrived on.
+type reflectConn struct {
+	Proto      string `json:"proto"`
+	RemoteAddr string `json:"remote_addr"`
+	LocalAddr  string `json:"local_addr,omitempty"`
+	// TLS is nil for plain-text connections.
+	TLS *reflectTLS `json:"tls"`
+}
+
+type reflectTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	// ALPN is the negotiated application protocol, such as "h2".
+	ALPN      string `json:"alpn,omitempty"`
+	Resumed   bool   `json:"resumed"`
+	PeerCerts int    `json:"peer_certificates"`
+}
+
+type reflectInfo struct {
+	Method   string              `json:"method"`
+	Path     string              `json:"path"`
+	RawPath  string              `json:"raw_path,omitempty"`
+	SubPath  string              `json:"sub_path"`
+	Segments []string            `json:"segments"`
+	Query    url.Values          `json:"query"`
+	Headers  map[string][]string `json:"headers"`
+	// Omitted counts headers beyond MaxRenderedHeaders.
+	Omitted  int                 `json:"headers_omitted,omitempty"`
+	Trailers map[string][]string `json:"trailers"`
+	BodySize int64               `json:"body_bytes"`
+	Conn     reflectConn         `json:"connection"`
+}
+
+// getReflectConn describes the connection r arrived on.
+func getReflectConn(r *http.Request) reflectConn {
+	conn := reflectConn{Proto: r.Proto, RemoteAddr: r.RemoteAddr}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.LocalAddr = addr.String()
+	}
+	if cs := r.TLS; cs != nil {
+		version, ok := tlsVersions[cs.Version]
+		if !ok {
+			version = fmt.Sprintf("0x%04x", cs.Version)
+		}
+		conn.TLS = &reflectTLS{
+			Version:     version,
+			CipherSuite: tls.CipherSuiteName(cs.CipherSuite),
+			ServerName:  cs.ServerName,
+			ALPN:        cs.NegotiatedProtocol,
+			Resumed:     cs.DidResume,
+			PeerCerts:   len(cs.PeerCertificates),
+		}
+	}
+	return conn
+}
+
+// reflectHandler echoes how the request path arrived, which helps check how
+// an ingress rewrites paths before they reach the app, along with the
+// headers, the trailers and the connection it came in on. The body is read
+// and discarded, as trailers are only known once it has been consumed.
+func reflectHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <reflectHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	if len(r.URL.Path) > maxReflectPath {
+		rejectRequest(w, rejectURLTooLong, http.StatusRequestURITooLong, http.StatusText(http.StatusRequestURITooLong))
+		return
+	}
+	sub := strings.TrimPrefix(r.URL.Path, "/reflect/")
+	// Split the escaped path so that an encoded slash (%2F) stays within
+	// its segment.
+	segments := []string{}
+	for _, seg := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/reflect/"), "/") {
+		if seg == "" {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			seg = unescaped
+		}
+		segments = append(segments, seg)
+	}
+	n, err := io.Copy(ioutil.Discard, http.MaxBytesReader(w, r.Body, maxReflectBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectRequest(w, rejectBodyTooLarge, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", maxReflectBody))
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+		return
+	}
+	trailers := map[string][]string{}
+	for name, values := range r.Trailer {
+		trailers[name] = values
+	}
+	headers, omitted := capHeaders(r.Header, currentConfig().MaxRenderedHeaders)
+	writeJSON(w, r, http.StatusOK, reflectInfo{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		SubPath:  sub,
+		Segments: segments,
+		Query:    r.URL.Query(),
+		Headers:  headers,
+		Omitted:  omitted,
+		Trailers: trailers,
+		BodySize: n,
+		Conn:     getReflectConn(r),
+	})
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Coarse error kinds for the handler_errors_total "kind" label.
+const (
+	errKindHostname    = "hostname"
+	errKindGateway     = "gateway"
+	errKindProcessList = "process_list"
+	errKindProcRead    = "proc_read"
+	errKindEncode      = "encode"
+	errKindUpdateCheck = "update_check"
+	errKindMetrics     = "metrics"
+	errKindDNSConfig   = "dns_config"
+)
+
+// handlerError logs an internal failure and counts it in
+// handler_errors_total under the matched route and kind. Handlers call it
+// even when they degrade gracefully and still answer 200, so that the
+// failure is visible in metrics.
+func handlerError(r *http.Request, kind, op string, err error) {
+	logFromCtx(r.Context()).Printf("%s: %v", op, err)
+	handlerErrors.WithLabelValues(routeFromCtx(r.Context()).pattern, kind).Inc()
+}
+
+// writeJSON writes v as indented JSON with the given status code, with
+// camelCase field names if JSONFieldCase says so. The body is encoded into
+// a buffer first so that it goes out with an accurate Content-Length, and
+// an encoding failure becomes a clean 500.
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	if currentConfig().JSONFieldCase == jsonCaseCamel {
+		v = camelJSON(v)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		handlerError(r, errKindEncode, "json.Encode()", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// bufferedWriter holds a response in memory until the handler returns.
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (bw *bufferedWriter) WriteHeader(code int) {
+	// A server error after output has been produced replaces that output,
+	// which is what buffering buys us over streaming.
+	if bw.status != 0 && code >= http.StatusInternalServerError && bw.status < http.StatusInternalServerError {
+		bw.buf.Reset()
+		bw.status = code
+		return
+	}
+	if bw.status == 0 {
+		bw.status = code
+	}
+}
+
+func (bw *bufferedWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	return bw.buf.Write(b)
+}
+
+// withResponseMode buffers the response of next when ResponseMode is
+// buffered, sending it with a Content-Length once next returns. In
+// streaming mode next writes straight through.
+func withResponseMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().ResponseMode != responseModeBuffered {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bw := &bufferedWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, r)
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(bw.buf.Len()))
+		w.WriteHeader(bw.status)
+		w.Write(bw.buf.Bytes())
+	})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       int
+		v          interface{}
+		wantCode   int
+		wantType   string
+		wantLength bool
+	}{
+		{"object", http.StatusOK, map[string]int{"a": 1}, http.StatusOK, "application/json", true},
+		{"status kept", http.StatusAccepted, []string{"x"}, http.StatusAccepted, "application/json", true},
+		{"unencodable", http.StatusOK, map[string]interface{}{"c": make(chan int)}, http.StatusInternalServerError, "text/plain; charset=utf-8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeJSON(rec, httptest.NewRequest(http.MethodGet, "/", nil), tt.code, tt.v)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			if !tt.wantLength {
+				return
+			}
+			if got, want := rec.Header().Get("Content-Length"), strconv.Itoa(rec.Body.Len()); got != want {
+				t.Errorf("Content-Length = %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// responseMax tracks the largest response body per route for the
+// http_response_max_bytes gauge, which only ever grows until reset.
+var responseMax = struct {
+	sync.Mutex
+	bytes map[string]int
+}{bytes: map[string]int{}}
+
+// observeResponseSize raises the http_response_max_bytes gauge for path
+// if n is the largest response seen there since startup or the last reset.
+func observeResponseSize(path string, n int) {
+	responseMax.Lock()
+	defer responseMax.Unlock()
+	if max, ok := responseMax.bytes[path]; ok && n <= max {
+		return
+	}
+	responseMax.bytes[path] = n
+	responseMaxBytes.WithLabelValues(path).Set(float64(n))
+}
+
+// responseBytes returns the body size recorded by the access log's
+// statusWriter beneath w, if there is one.
+func responseBytes(w http.ResponseWriter) (int, bool) {
+	for {
+		switch rw := w.(type) {
+		case *statusWriter:
+			return rw.bytes, true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return 0, false
+		}
+	}
+}
+
+// metricsResetHandler serves POST /metrics/reset: it clears the
+// high-water mark gauges (http_response_max_bytes) so they track from
+// now on. It requires the admin token.
+func metricsResetHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <metricsResetHandler>", getOnelineInfo(r))
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		rejectRequest(w, rejectMethodNotAllowed, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !requireToken(w, r) {
+		return
+	}
+
+	responseMax.Lock()
+	responseMax.bytes = map[string]int{}
+	responseMaxBytes.Reset()
+	responseMax.Unlock()
+	writeJSON(w, r, http.StatusOK, map[string][]string{"reset": {"http_response_max_bytes"}})
+
+	httpReqs.Inc()
+}
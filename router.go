@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// route is an entry in the application's route registry.
+type route struct {
+	name     string
+	pattern  string
+	handler  http.Handler
+	disabled bool
+}
+
+// registeredRoutes is the registry as built by newRouter, for /routes.
+var registeredRoutes []route
+
+var (
+	requestedMu     sync.Mutex
+	requestedRoutes = map[string]bool{}
+)
+
+func appRoutes() []route {
+	// Instrument helloHandler
+	helloHandler := http.HandlerFunc(doHelloHandler)
+	wrappedHelloHandler := promhttp.InstrumentHandlerCounter(
+		requestCount,
+		promhttp.InstrumentHandlerDuration(
+			requestDuration,
+			promhttp.InstrumentHandlerResponseSize(
+				responseSize,
+				helloHandler),
+		),
+	)
+
+	return []route{
+		{name: "hello", pattern: "/", handler: wrappedHelloHandler},
+		{name: "oneline", pattern: "/oneline", handler: http.HandlerFunc(onelineHandler)},
+		{name: "ps", pattern: "/ps", handler: withResponseMode(http.HandlerFunc(psHandler))},
+		{name: "version", pattern: "/version", handler: http.HandlerFunc(versionHandler)},
+		{name: "version-json", pattern: "/version/json", handler: http.HandlerFunc(versionJSONHandler)},
+		{name: "compare-versions", pattern: "/compare/versions", handler: http.HandlerFunc(compareVersionsHandler)},
+		{name: "now", pattern: "/now", handler: http.HandlerFunc(nowHandler)},
+		{name: "color", pattern: "/color", handler: http.HandlerFunc(colorHandler)},
+		{name: "base64", pattern: "/base64", handler: http.HandlerFunc(base64Handler)},
+		{name: "hash", pattern: "/hash", handler: http.HandlerFunc(hashHandler)},
+		{name: "reflect", pattern: "/reflect/", handler: http.HandlerFunc(reflectHandler)},
+		{name: "env", pattern: "/env", handler: http.HandlerFunc(envHandler)},
+		{name: "env-var", pattern: "/env/", handler: http.HandlerFunc(envVarHandler)},
+		{name: "config", pattern: "/config", handler: http.HandlerFunc(configHandler)},
+		{name: "proc", pattern: "/proc/", handler: withResponseMode(http.HandlerFunc(procFileHandler))},
+		{name: "diag", pattern: "/diag", handler: withResponseMode(http.HandlerFunc(diagHandler))},
+		{name: "batch", pattern: "/batch", handler: http.HandlerFunc(batchHandler)},
+		{name: "diskusage", pattern: "/diskusage", handler: http.HandlerFunc(diskUsageHandler)},
+		{name: "fsinfo", pattern: "/fsinfo", handler: http.HandlerFunc(fsInfoHandler)},
+		{name: "connections", pattern: "/connections", handler: withResponseMode(http.HandlerFunc(connectionsHandler))},
+		{name: "cgroup", pattern: "/cgroup", handler: http.HandlerFunc(cgroupHandler)},
+		{name: "limits-cgroup", pattern: "/limits/cgroup", handler: http.HandlerFunc(cgroupLimitsHandler)},
+		{name: "host-meminfo", pattern: "/host/meminfo", handler: http.HandlerFunc(hostMemInfoHandler)},
+		{name: "dnsconfig", pattern: "/dnsconfig", handler: http.HandlerFunc(dnsConfigHandler)},
+		{name: "gateway", pattern: "/gateway", handler: http.HandlerFunc(gatewayHandler)},
+		{name: "geo", pattern: "/geo", handler: http.HandlerFunc(geoHandler)},
+		{name: "selfupdate-check", pattern: "/selfupdate/check", handler: http.HandlerFunc(selfUpdateCheckHandler)},
+		{name: "echo-stream", pattern: "/echo/stream", handler: http.HandlerFunc(echoStreamHandler)},
+		{name: "events", pattern: "/events", handler: http.HandlerFunc(eventsHandler)},
+		{name: "slow-headers", pattern: "/slow-headers", handler: http.HandlerFunc(slowHeadersHandler)},
+		{name: "debug-gc", pattern: "/debug/gc", handler: http.HandlerFunc(debugGCHandler)},
+		{name: "debug-goroutines", pattern: "/debug/goroutines", handler: http.HandlerFunc(debugGoroutinesHandler)},
+		{name: "debug-metrics-check", pattern: "/debug/metrics/check", handler: http.HandlerFunc(debugMetricsCheckHandler)},
+		{name: "fetch", pattern: "/fetch", handler: http.HandlerFunc(fetchHandler)},
+		{name: "ping-tcp", pattern: "/ping/tcp", handler: http.HandlerFunc(tcpPingHandler)},
+		{name: "readyz", pattern: "/readyz", handler: http.HandlerFunc(readyzHandler)},
+		{name: "ready-ports", pattern: "/ready/ports", handler: http.HandlerFunc(readyPortsHandler)},
+		{name: "logs-tail", pattern: "/logs/tail", handler: http.HandlerFunc(logsTailHandler)},
+		{name: "metrics-reset", pattern: "/metrics/reset", handler: http.HandlerFunc(metricsResetHandler)},
+		{name: "toppaths", pattern: "/toppaths", handler: http.HandlerFunc(topPathsHandler)},
+		{name: "routes", pattern: "/routes", handler: http.HandlerFunc(routesHandler)},
+	}
+}
+
+// newRouter registers the application routes, answering 404 for those
+// listed in c.DisabledRoutes or disabled by name in c.Endpoints, which
+// wins for a route both mention. Disabled routes are registered explicitly so
+// they don't fall through to the catch-all "/" handler. Unless
+// c.TrailingSlash is off, each fixed route is also registered with a
+// trailing slash, handled by withTrailingSlash.
+func newRouter(c *Config) *http.ServeMux {
+	disabled := make(map[string]bool, len(c.DisabledRoutes))
+	for _, pattern := range c.DisabledRoutes {
+		disabled[pattern] = true
+	}
+
+	endpoints := make(map[string]bool, len(c.Endpoints))
+	for name, enabled := range c.Endpoints {
+		endpoints[name] = enabled
+	}
+
+	mux := http.NewServeMux()
+	routes := appRoutes()
+	var enabled []string
+	for i, rt := range routes {
+		off := disabled[rt.pattern]
+		delete(disabled, rt.pattern)
+		if on, ok := endpoints[rt.name]; ok {
+			off = !on
+			delete(endpoints, rt.name)
+		}
+		if off && probePaths[rt.pattern] {
+			log.Printf("route %s is a probe and cannot be disabled", rt.pattern)
+			off = false
+		}
+		if off {
+			log.Printf("route %s disabled", rt.pattern)
+			mux.Handle(rt.pattern, http.HandlerFunc(notFound))
+			routes[i].disabled = true
+			continue
+		}
+		enabled = append(enabled, rt.name)
+		h := withRoute(rt, rt.handler)
+		if rt.pattern == "/" {
+			h = withStrictRoot(h)
+		}
+		mux.Handle(rt.pattern, h)
+	}
+	if c.TrailingSlash != trailingSlashOff {
+		patterns := make(map[string]bool, len(routes))
+		for _, rt := range routes {
+			patterns[rt.pattern] = true
+		}
+		for _, rt := range routes {
+			slashed := rt.pattern + "/"
+			if rt.disabled || strings.HasSuffix(rt.pattern, "/") || patterns[slashed] {
+				continue
+			}
+			mux.Handle(slashed, withTrailingSlash(c.TrailingSlash, rt.pattern, withRoute(rt, rt.handler)))
+		}
+	}
+	for pattern := range disabled {
+		log.Printf("DISABLED_ROUTES: no route %s", pattern)
+	}
+	for name := range endpoints {
+		log.Printf("ENDPOINTS: no route named %s", name)
+	}
+	if len(c.Endpoints) > 0 || len(c.DisabledRoutes) > 0 {
+		log.Printf("endpoints enabled: %s", strings.Join(enabled, ","))
+	}
+	registeredRoutes = routes
+	return mux
+}
+
+// withTrailingSlash serves canonical+"/" according to policy: redirect
+// to canonical with 308, or serve next as if canonical had been
+// requested. Deeper paths under canonical+"/" are not matched.
+func withTrailingSlash(policy, canonical string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != canonical+"/" {
+			notFound(w, r)
+			return
+		}
+		if policy == trailingSlashRedirect {
+			target := canonical
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+			return
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path, u.RawPath = canonical, ""
+		r2.URL = &u
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// withStrictRoot restricts the catch-all "/" route to the exact path "/"
+// when StrictRoot is set, answering any other unmatched path with
+// strictRootFallback. It wraps the route from outside withRoute, so those
+// paths are not counted as requests for "/".
+func withStrictRoot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().StrictRoot && r.URL.Path != "/" {
+			strictRootFallback(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type routeInfo struct {
+	Name     string `json:"name"`
+	Pattern  string `json:"pattern"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// rootFallbacks describes the STRICT_ROOT_FALLBACK options for /routes.
+var rootFallbacks = map[string]string{
+	rootFallbackNotFound: "404 page not found",
+	rootFallbackHint:     "404 with a pointer to /routes",
+	rootFallbackRedirect: "302 redirect to /",
+}
+
+type routesInfo struct {
+	RootMode string `json:"root_mode"`
+	// RootFallback is how unmatched paths are answered in strict mode,
+	// one of RootFallbacks.
+	RootFallback  string            `json:"root_fallback,omitempty"`
+	RootFallbacks map[string]string `json:"root_fallback_options,omitempty"`
+	Routes        []routeInfo       `json:"routes"`
+}
+
+// routesHandler lists the route registry and how "/" matches paths.
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <routesHandler>", getOnelineInfo(r))
+
+	c := currentConfig()
+	info := routesInfo{
+		RootMode:      "strict: only the exact path / is served by hello; other unmatched paths get root_fallback",
+		RootFallback:  c.StrictRootFallback,
+		RootFallbacks: rootFallbacks,
+	}
+	if !c.StrictRoot {
+		info = routesInfo{RootMode: "catch-all: every unmatched path is served by hello"}
+	}
+	for _, rt := range registeredRoutes {
+		info.Routes = append(info.Routes, routeInfo{Name: rt.name, Pattern: rt.pattern, Disabled: rt.disabled})
+	}
+	writeJSON(w, r, http.StatusOK, info)
+
+	httpReqs.Inc()
+}
+
+// withRoute records rt in the request context for routeFromCtx, counts
+// the request in http_route_requests_total and, unless rt is a probe, in
+// application_requests_total, counts rt towards
+// http_routes_requested the first time it is hit, and feeds the response
+// size to http_response_max_bytes. With RouteHeader set it names the route
+// in an X-Route response header.
+func withRoute(rt route, next http.Handler) http.Handler {
+	var seen int32
+	probe := probePaths[rt.pattern]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentConfig().RouteHeader {
+			w.Header().Set("X-Route", rt.name)
+		}
+		routeRequests.WithLabelValues(rt.pattern).Inc()
+		if !probe {
+			applicationRequests.Inc()
+		}
+		if atomic.CompareAndSwapInt32(&seen, 0, 1) {
+			markRouteRequested(rt.pattern)
+		}
+		if slot, ok := r.Context().Value(routeSlotKey).(*route); ok {
+			*slot = rt
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey, rt)))
+		if n, ok := responseBytes(w); ok {
+			observeResponseSize(rt.pattern, n)
+		}
+	})
+}
+
+// markRouteRequested adds pattern to the set of requested routes. The set
+// is keyed by pattern so a router rebuilt with the same routes does not
+// count them twice.
+func markRouteRequested(pattern string) {
+	requestedMu.Lock()
+	defer requestedMu.Unlock()
+	if !requestedRoutes[pattern] {
+		requestedRoutes[pattern] = true
+		routesRequested.Set(float64(len(requestedRoutes)))
+	}
+}
+
+// unroutedPath labels request_context_cancellations_total for requests
+// abandoned in middleware, before a route was matched.
+const unroutedPath = "unrouted"
+
+// observeCancellation counts r in request_context_cancellations_total if
+// ctx, the request's context or one derived from it, is done.
+func observeCancellation(ctx context.Context, r *http.Request) {
+	if ctx.Err() == nil {
+		return
+	}
+	path := routeFromCtx(r.Context()).pattern
+	if path == "" {
+		path = unroutedPath
+	}
+	contextCancellations.WithLabelValues(path).Inc()
+}
+
+// routeFromCtx returns the registry entry that matched the request, or a
+// zero route if none did.
+func routeFromCtx(ctx context.Context) route {
+	rt, _ := ctx.Value(routeKey).(route)
+	return rt
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewRouterKeepsProbes(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(c *Config)
+	}{
+		{"DISABLED_ROUTES", func(c *Config) { c.DisabledRoutes = []string{"/readyz", "/ready/ports"} }},
+		{"ENDPOINTS", func(c *Config) { c.Endpoints = map[string]bool{"readyz": false, "ready-ports": false} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.configure(c)
+			router := newRouter(c)
+			for path := range probePaths {
+				rec := httptest.NewRecorder()
+				router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code == http.StatusNotFound {
+					t.Errorf("%s answered 404, want the probe served", path)
+				}
+			}
+		})
+	}
+}
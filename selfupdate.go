@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// maxVersionBody caps how much of the remote version document is read.
+const maxVersionBody = 256
+
+var updateCheckClient = &http.Client{
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect to %s URL", req.URL.Scheme)
+		}
+		if len(via) >= 5 {
+			return errors.New("stopped after 5 redirects")
+		}
+		return nil
+	},
+}
+
+type updateCheck struct {
+	Current         string `json:"current"`
+	Latest          string `json:"latest"`
+	UpdateAvailable bool   `json:"update_available"`
+}
+
+// fetchLatestVersion reads a version string from url, which is expected
+// to return nothing but the version, e.g. "1.3".
+func fetchLatestVersion(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := updateCheckClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxVersionBody))
+	if err != nil {
+		return "", err
+	}
+	latest := strings.TrimSpace(string(body))
+	if latest == "" {
+		return "", fmt.Errorf("GET %s: empty version", url)
+	}
+	return latest, nil
+}
+
+// selfUpdateCheckHandler compares the running version with the one
+// published at UpdateCheckURL. It is disabled unless that is set.
+func selfUpdateCheckHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <selfUpdateCheckHandler>", getOnelineInfo(r))
+
+	c := currentConfig()
+	if c.UpdateCheckURL == "" {
+		http.NotFound(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), c.UpdateCheckTimeout)
+	defer cancel()
+	defer observeCancellation(ctx, r)
+	var latest string
+	var err error
+	if !runOutbound(ctx, w, func() { latest, err = fetchLatestVersion(ctx, c.UpdateCheckURL) }) {
+		return
+	}
+	if err != nil {
+		handlerError(r, errKindUpdateCheck, "fetchLatestVersion()", err)
+		writeJSON(w, r, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	cmp, err := compareVersions(version, latest)
+	if err != nil {
+		handlerError(r, errKindUpdateCheck, "compareVersions()", err)
+		writeJSON(w, r, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, updateCheck{
+		Current:         version,
+		Latest:          latest,
+		UpdateAvailable: cmp < 0,
+	})
+
+	httpReqs.Inc()
+}
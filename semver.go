@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// semver is a parsed version: numeric core components and optional
+// pre-release identifiers. Build metadata is dropped, as it does not
+// affect precedence.
+type semver struct {
+	core []int
+	pre  []string
+}
+
+// parseSemver parses versions such as "1.2", "v1.10.0" and
+// "2.0.0-rc.1+build.5". Unlike strict SemVer, the core may have any
+// number of components; missing ones compare as zero.
+func parseSemver(s string) (semver, error) {
+	var v semver
+	rest := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		if !validIdentifiers(rest[i+1:]) {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		rest = rest[:i]
+	}
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		if !validIdentifiers(rest[i+1:]) {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		v.pre = strings.Split(rest[i+1:], ".")
+		rest = rest[:i]
+	}
+	for _, part := range strings.Split(rest, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || part[0] == '+' {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		v.core = append(v.core, n)
+	}
+	return v, nil
+}
+
+// validIdentifiers reports whether s is a dot-separated list of non-empty
+// [0-9A-Za-z-] identifiers.
+func validIdentifiers(s string) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, c := range id {
+			if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compare returns -1, 0 or 1 following SemVer precedence: core components
+// numerically, then a pre-release sorts before the release itself.
+func (v semver) compare(o semver) int {
+	for i := 0; i < len(v.core) || i < len(o.core); i++ {
+		var x, y int
+		if i < len(v.core) {
+			x = v.core[i]
+		}
+		if i < len(o.core) {
+			y = o.core[i]
+		}
+		if c := compareInts(x, y); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(v.pre) == 0 && len(o.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(o.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(o.pre); i++ {
+		if c := comparePreIdentifiers(v.pre[i], o.pre[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(len(v.pre), len(o.pre))
+}
+
+// comparePreIdentifiers orders numeric identifiers numerically and before
+// alphanumeric ones, which are ordered lexically.
+func comparePreIdentifiers(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA == nil && errB == nil:
+		return compareInts(x, y)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func compareInts(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// compareVersions compares two versions as parsed by parseSemver,
+// returning -1, 0 or 1.
+func compareVersions(a, b string) (int, error) {
+	va, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.compare(vb), nil
+}
+
+type versionComparison struct {
+	A      string `json:"a"`
+	B      string `json:"b"`
+	Result int    `json:"result"`
+	// Description reads like "1.2 < 1.3".
+	Description string `json:"description"`
+}
+
+// compareVersionsHandler serves /compare/versions?a=1.2&b=1.3, answering
+// -1, 0 or 1 as a is older than, the same as, or newer than b.
+func compareVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <compareVersionsHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	a, b := q.Get("a"), q.Get("b")
+	if a == "" || b == "" {
+		http.Error(w, "a and b are required", http.StatusBadRequest)
+		return
+	}
+	cmp, err := compareVersions(a, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	op := map[int]string{-1: "<", 0: "==", 1: ">"}[cmp]
+	writeJSON(w, r, http.StatusOK, versionComparison{
+		A:           a,
+		B:           b,
+		Result:      cmp,
+		Description: fmt.Sprintf("%s %s %s", a, op, b),
+	})
+
+	httpReqs.Inc()
+}
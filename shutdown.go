@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []shutdownHook
+)
+
+// onShutdown registers fn to be called during graceful shutdown. Hooks run
+// in reverse registration order, so subsystems started later are stopped
+// first.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// goTracked runs fn in a new goroutine counted in app_goroutines under
+// name, so leaks in the app's own background work show up separately from
+// go_goroutines. Use it for long-lived goroutines, not per-request ones.
+func goTracked(name string, fn func()) {
+	g := appGoroutines.WithLabelValues(name)
+	g.Inc()
+	go func() {
+		defer g.Dec()
+		fn()
+	}()
+}
+
+// goWithShutdown runs fn in a new goroutine and registers a shutdown hook
+// that cancels fn's context and waits for it to return.
+func goWithShutdown(name string, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	goTracked(name, func() {
+		defer close(done)
+		fn(ctx)
+	})
+	onShutdown(name, func(hookCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-hookCtx.Done():
+			return hookCtx.Err()
+		}
+	})
+}
+
+// takeShutdownHooks returns the registered hooks and clears them, so that
+// each runs at most once.
+func takeShutdownHooks() []shutdownHook {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	return hooks
+}
+
+// runShutdownHooks invokes the registered hooks as runHooks does.
+func runShutdownHooks(timeout time.Duration) {
+	runHooks(takeShutdownHooks(), timeout)
+}
+
+// exitDuringStartup handles sig arriving before the app server is up: it
+// runs hooks, stopping whatever was started so far, and calls exit with
+// status 0.
+func exitDuringStartup(sig os.Signal, hooks []shutdownHook, timeout time.Duration, exit func(code int)) {
+	log.Printf("received %s during startup, exiting", sig)
+	runHooks(hooks, timeout)
+	exit(0)
+}
+
+// runHooks invokes hooks in reverse order, giving each at most timeout to
+// complete. A hook that overruns is abandoned and the next one is started.
+func runHooks(hooks []shutdownHook, timeout time.Duration) {
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		done := make(chan error, 1)
+		go func() {
+			done <- hook.fn(ctx)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Printf("shutdown hook %q: %v", hook.name, err)
+			} else {
+				log.Printf("shutdown hook %q completed", hook.name)
+			}
+		case <-ctx.Done():
+			log.Printf("shutdown hook %q timed out after %s", hook.name, timeout)
+		}
+		cancel()
+	}
+}
+
+// shutdownAppServer returns a hook that gracefully shuts srv down, logging
+// how many requests were in flight and whether they all finished before
+// the hook's deadline.
+func shutdownAppServer(srv *http.Server) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		log.Printf("%d requests in flight at shutdown", inFlightRequests())
+		err := srv.Shutdown(ctx)
+		if n := inFlightRequests(); err != nil && n > 0 {
+			log.Printf("WARNING: shutdown deadline reached with %d requests still in flight", n)
+		} else if err == nil {
+			log.Printf("all in-flight requests completed")
+		}
+		return err
+	}
+}
+
+// drainLogInterval is how often progress is logged during the drain delay.
+const drainLogInterval = 2 * time.Second
+
+// openConns counts the app server's connections that are not yet closed,
+// as tracked by trackConnState.
+var openConns int64
+
+// trackConnState is the app server's ConnState hook. Hijacked connections
+// are no longer the server's to drain, so they count as closed.
+func trackConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&openConns, 1)
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&openConns, -1)
+	}
+}
+
+// drainDelay returns a hook that waits delay before the app server is shut
+// down, so load balancers that have seen /readyz fail stop sending new
+// connections first. It logs the open connections and in-flight requests
+// every drainLogInterval meanwhile.
+func drainDelay(delay time.Duration) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		log.Printf("draining for %s: %d connections open, %d requests in flight", delay, atomic.LoadInt64(&openConns), inFlightRequests())
+		ticker := time.NewTicker(drainLogInterval)
+		defer ticker.Stop()
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+				log.Printf("drain complete: %d connections open, %d requests in flight", atomic.LoadInt64(&openConns), inFlightRequests())
+				return nil
+			case <-ticker.C:
+				log.Printf("draining: %d connections open, %d requests in flight", atomic.LoadInt64(&openConns), inFlightRequests())
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestMain lets a test re-run the binary as the app itself: with
+// TEST_RUN_MAIN set, it runs main instead of the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("TEST_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// freePort returns a TCP port that nothing was listening on just now.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestSignalDuringStartup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGTERM cannot be sent on windows")
+	}
+	appPort, metricsPort := freePort(t), freePort(t)
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(),
+		"TEST_RUN_MAIN=1",
+		"STARTUP_DELAY=1m",
+		"APP_PORT="+strconv.Itoa(appPort),
+		"METRICS_PORT="+strconv.Itoa(metricsPort),
+	)
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pr.Close()
+	cmd.Stdout, cmd.Stderr = pw, pw
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	timer := time.AfterFunc(30*time.Second, func() { cmd.Process.Kill() })
+	defer timer.Stop()
+
+	var out []string
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		out = append(out, line)
+		if strings.Contains(line, "STARTUP_DELAY: waiting") {
+			if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+				cmd.Process.Kill()
+				t.Fatal(err)
+			}
+		}
+	}
+	err = cmd.Wait()
+	output := strings.Join(out, "\n")
+	if err != nil {
+		t.Fatalf("app exited with %v, want status 0; output:\n%s", err, output)
+	}
+	if !strings.Contains(output, "during startup, exiting") {
+		t.Errorf("app did not exit through the startup path; output:\n%s", output)
+	}
+	if strings.Contains(output, "serving metrics at") || strings.Contains(output, "serving TLS at") {
+		t.Errorf("app started listening before exiting; output:\n%s", output)
+	}
+}
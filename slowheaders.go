@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Bounds and default of the delay /slow-headers waits before the body.
+const (
+	defaultSlowHeadersDelay = time.Second
+	maxSlowHeadersDelay     = 30 * time.Second
+)
+
+// slowHeadersHandler serves /slow-headers?delay=2s: the status and headers
+// are written and flushed at once, and the body follows after delay (at
+// most maxSlowHeadersDelay). It shows whether a proxy in front buffers the
+// response until the body arrives. A client that goes away during the
+// delay ends the request without a body.
+func slowHeadersHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <slowHeadersHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	delay := defaultSlowHeadersDelay
+	if v := r.URL.Query().Get("delay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > maxSlowHeadersDelay {
+			http.Error(w, fmt.Sprintf("delay must be a duration between 0 and %s", maxSlowHeadersDelay), http.StatusBadRequest)
+			return
+		}
+		delay = d
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	httpReqs.Inc()
+
+	start := time.Now()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-r.Context().Done():
+		observeCancellation(r.Context(), r)
+		logFromCtx(r.Context()).Printf("slow-headers: client went away after %s of %s", time.Since(start).Round(time.Millisecond), delay)
+		return
+	case <-timer.C:
+	}
+	fmt.Fprintf(w, "body sent %s after the headers\n", delay)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// activeStreams counts open long-lived responses such as /events.
+var activeStreams int64
+
+// acquireStream reserves one of MaxStreams stream slots. When all are
+// taken it answers 503 itself and returns false; otherwise the caller
+// must call releaseStream when the stream ends.
+func acquireStream(w http.ResponseWriter) bool {
+	max := int64(currentConfig().MaxStreams)
+	for {
+		n := atomic.LoadInt64(&activeStreams)
+		if n >= max {
+			w.Header().Set("Retry-After", "1")
+			rejectRequest(w, rejectOverloaded, http.StatusServiceUnavailable, "too many open streams")
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&activeStreams, n, n+1) {
+			streamsActive.Inc()
+			return true
+		}
+	}
+}
+
+func releaseStream() {
+	atomic.AddInt64(&activeStreams, -1)
+	streamsActive.Dec()
+}
+
+// streamContext bounds a stream to MaxStreamDuration, returning the
+// context to serve it under and the time it must end by. The returned
+// func must be called when the stream ends; it logs streams cut off by
+// the cap.
+func streamContext(r *http.Request) (context.Context, time.Time, func()) {
+	d := currentConfig().MaxStreamDuration
+	deadline := time.Now().Add(d)
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	return ctx, deadline, func() {
+		if !time.Now().Before(deadline) {
+			logFromCtx(r.Context()).Printf("stream closed after MAX_STREAM_DURATION (%s)", d)
+		}
+		cancel()
+	}
+}
+
+const (
+	minEventsInterval     = 100 * time.Millisecond
+	maxEventsInterval     = time.Minute
+	defaultEventsInterval = time.Second
+)
+
+// tickEvent is the data of an /events "tick" event.
+type tickEvent struct {
+	Time          string  `json:"time"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// eventsHandler streams server-sent "tick" events carrying the time and
+// uptime every interval (default 1s) until the client goes away or
+// MaxStreamDuration has passed.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <eventsHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	interval := defaultEventsInterval
+	if v := r.URL.Query().Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < minEventsInterval || d > maxEventsInterval {
+			http.Error(w, fmt.Sprintf("interval must be a duration between %s and %s", minEventsInterval, maxEventsInterval), http.StatusBadRequest)
+			return
+		}
+		interval = d
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !acquireStream(w) {
+		return
+	}
+	defer releaseStream()
+	ctx, _, done := streamContext(r)
+	defer done()
+	// Only the client going away counts, not the MaxStreamDuration cutoff.
+	defer observeCancellation(r.Context(), r)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	httpReqs.Inc()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for id := 1; ; id++ {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var event interface{} = tickEvent{
+				Time:          now.Format(time.RFC3339Nano),
+				UptimeSeconds: time.Since(startTime).Seconds(),
+			}
+			if currentConfig().JSONFieldCase == jsonCaseCamel {
+				event = camelJSON(event)
+			}
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: tick\ndata: %s\n\n", id, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// maxEchoStream bounds the body /echo/stream copies back.
+const maxEchoStream = 16 * 1024 * 1024
+
+// flushWriter flushes after every write, so data reaches the client as
+// soon as it has been read, and stops once ctx is done.
+type flushWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	if err := fw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := fw.w.Write(p)
+	fw.flusher.Flush()
+	return n, err
+}
+
+// echoStreamHandler copies the request body back to the client as it
+// arrives, up to maxEchoStream bytes and for at most MaxStreamDuration.
+// HTTP/1 requests are only streamed when built with go1.21 or later;
+// older toolchains buffer the body.
+func echoStreamHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <echoStreamHandler>", getOnelineInfo(r))
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if r.ContentLength > maxEchoStream {
+		rejectRequest(w, rejectBodyTooLarge, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", maxEchoStream))
+		return
+	}
+	if !acquireStream(w) {
+		return
+	}
+	defer releaseStream()
+	ctx, deadline, done := streamContext(r)
+	defer done()
+	defer observeCancellation(r.Context(), r)
+	// A client that stops sending would otherwise hold the stream open
+	// past the deadline in Read. Builds older than go1.21 cannot set it
+	// and leave that to the server's timeouts.
+	setReadDeadline(w, deadline)
+
+	body := io.LimitReader(r.Body, maxEchoStream)
+	if r.ProtoMajor == 1 {
+		if err := enableFullDuplex(w); err != nil {
+			// Without full duplex, net/http closes an HTTP/1 request body
+			// once the response starts, so read it all first.
+			logFromCtx(r.Context()).Printf("echo stream: buffering body: %v", err)
+			data, err := ioutil.ReadAll(body)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+				return
+			}
+			body = bytes.NewReader(data)
+		}
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// The first Write sends the headers; writing them before the first Read
+	// would refuse a client waiting on "Expect: 100-continue".
+	n, err := io.Copy(flushWriter{ctx, w, flusher}, body)
+	if err != nil {
+		logFromCtx(r.Context()).Printf("echo stream stopped after %d bytes: %v", n, err)
+		return
+	}
+
+	httpReqs.Inc()
+}
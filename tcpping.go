@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// maxPingCount bounds the count parameter of /ping/tcp.
+	maxPingCount = 20
+	// pingBudget bounds the total time /ping/tcp spends on one request.
+	pingBudget = 10 * time.Second
+	// pingDialTimeout bounds each individual connect.
+	pingDialTimeout = 2 * time.Second
+	// pingInterval separates consecutive connects.
+	pingInterval = 200 * time.Millisecond
+)
+
+type tcpPingResult struct {
+	Addr      string   `json:"addr"`
+	Count     int      `json:"count"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	MinMs     float64  `json:"min_ms,omitempty"`
+	AvgMs     float64  `json:"avg_ms,omitempty"`
+	MaxMs     float64  `json:"max_ms,omitempty"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// tcpPing connects to addr count times and summarizes connect latency.
+// It stops early, counting the remaining attempts as failed, when ctx is
+// done.
+func tcpPing(ctx context.Context, addr string, count int) tcpPingResult {
+	res := tcpPingResult{Addr: addr, Count: count}
+	var total time.Duration
+	dialer := net.Dialer{Timeout: pingDialTimeout}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(pingInterval):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			res.Failed += count - i
+			res.Errors = append(res.Errors, ctx.Err().Error())
+			break
+		}
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		rtt := time.Since(start)
+		if err != nil {
+			res.Failed++
+			res.Errors = append(res.Errors, err.Error())
+			continue
+		}
+		conn.Close()
+		ms := float64(rtt) / float64(time.Millisecond)
+		if res.Succeeded == 0 || ms < res.MinMs {
+			res.MinMs = ms
+		}
+		if ms > res.MaxMs {
+			res.MaxMs = ms
+		}
+		total += rtt
+		res.Succeeded++
+	}
+	if res.Succeeded > 0 {
+		res.AvgMs = float64(total) / float64(time.Millisecond) / float64(res.Succeeded)
+	}
+	return res
+}
+
+// tcpPingHandler serves /ping/tcp?addr=host:port&count=n. It makes
+// outbound connections, so it requires the admin token.
+func tcpPingHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <tcpPingHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	if !requireToken(w, r) {
+		return
+	}
+	addr := r.URL.Query().Get("addr")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		http.Error(w, "addr must be host:port", http.StatusBadRequest)
+		return
+	}
+	count := 4
+	if v := r.URL.Query().Get("count"); v != "" {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil || count <= 0 || count > maxPingCount {
+			http.Error(w, "count must be between 1 and "+strconv.Itoa(maxPingCount), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), pingBudget)
+	defer cancel()
+	defer observeCancellation(ctx, r)
+	var res tcpPingResult
+	if !runOutbound(ctx, w, func() { res = tcpPing(ctx, addr, count) }) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, res)
+
+	httpReqs.Inc()
+}
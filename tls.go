@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var tlsHandshakeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "tls_handshake_errors_total",
+	Help: "Number of failed TLS handshakes on the app server.",
+})
+
+// handshakeErrorCounter passes server error log output through to w,
+// counting the "TLS handshake error" lines net/http logs for failed
+// handshakes, which are otherwise not observable.
+type handshakeErrorCounter struct {
+	w io.Writer
+}
+
+func (h handshakeErrorCounter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte("TLS handshake error")) {
+		tlsHandshakeErrors.Inc()
+	}
+	return h.w.Write(p)
+}
+
+// newTLSErrorLog returns a server ErrorLog that counts handshake failures
+// and registers the metric for them. Call it only when TLS is enabled. It
+// writes wherever the standard logger does at the time, so the lines also
+// reach recentLogs.
+func newTLSErrorLog() *log.Logger {
+	tlsHandshakeErrors = register(registry, tlsHandshakeErrors).(prometheus.Counter)
+	return log.New(handshakeErrorCounter{log.Writer()}, "", log.LstdFlags)
+}
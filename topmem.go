@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxTopMemCount bounds TOP_MEM_COUNT.
+const maxTopMemCount = 50
+
+// memConsumer is a process and its resident set size.
+type memConsumer struct {
+	pid  int
+	name string
+	rss  uint64
+}
+
+// parseVmRSS returns the VmRSS of a /proc/<pid>/status file in bytes.
+// Kernel threads have none.
+func parseVmRSS(status string) (uint64, bool) {
+	for _, line := range strings.Split(status, "\n") {
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "VmRSS:"))
+		if len(fields) == 0 {
+			return 0, false
+		}
+		kb, err := strconv.ParseUint(fields[0], 10, 64)
+		return kb * 1024, err == nil
+	}
+	return 0, false
+}
+
+// topMemConsumers returns the n processes with the largest RSS, largest
+// first. Processes that exit while being read are skipped.
+func topMemConsumers(ctx context.Context, n int) ([]memConsumer, error) {
+	processes, err := listProcesses(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var consumers []memConsumer
+	for _, p := range processes {
+		status, err := readProcFile(strconv.Itoa(p.Pid()), "status")
+		if err != nil {
+			continue
+		}
+		if rss, ok := parseVmRSS(string(status)); ok {
+			consumers = append(consumers, memConsumer{pid: p.Pid(), name: p.Executable(), rss: rss})
+		}
+	}
+	sort.Slice(consumers, func(i, j int) bool { return consumers[i].rss > consumers[j].rss })
+	if len(consumers) > n {
+		consumers = consumers[:n]
+	}
+	return consumers, nil
+}
+
+// logTopMem logs the n processes with the largest RSS every interval until
+// ctx is cancelled.
+func logTopMem(ctx context.Context, interval time.Duration, n int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		consumers, err := topMemConsumers(ctx, n)
+		if err != nil {
+			log.Printf("top memory: %v", err)
+			continue
+		}
+		parts := make([]string, len(consumers))
+		for i, mc := range consumers {
+			parts[i] = fmt.Sprintf("%s[%d] %.1fMiB", mc.name, mc.pid, float64(mc.rss)/(1<<20))
+		}
+		log.Printf("top memory: %s", strings.Join(parts, ", "))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type pathCount struct {
+	Path     string  `json:"path"`
+	Requests float64 `json:"requests"`
+}
+
+// counterValue reads the current value of c.
+func counterValue(c prometheus.Counter) (float64, error) {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		return 0, err
+	}
+	return pb.GetCounter().GetValue(), nil
+}
+
+// routeRequestCounts reads back http_route_requests_total, sorted by
+// request count, most requested first.
+func routeRequestCounts() ([]pathCount, error) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		routeRequests.Collect(ch)
+		close(ch)
+	}()
+	var counts []pathCount
+	var err error
+	for m := range ch {
+		var pb dto.Metric
+		if werr := m.Write(&pb); werr != nil {
+			err = werr
+			continue
+		}
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "path" {
+				counts = append(counts, pathCount{Path: l.GetValue(), Requests: pb.GetCounter().GetValue()})
+			}
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Requests != counts[j].Requests {
+			return counts[i].Requests > counts[j].Requests
+		}
+		return counts[i].Path < counts[j].Path
+	})
+	return counts, err
+}
+
+// topPathsHandler lists the n most requested routes since startup, where
+// n defaults to TopPaths.
+func topPathsHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <topPathsHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	n := currentConfig().TopPaths
+	if v := r.URL.Query().Get("n"); v != "" {
+		var err error
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	counts, err := routeRequestCounts()
+	if err != nil {
+		handlerError(r, errKindEncode, "routeRequestCounts()", err)
+	}
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	writeJSON(w, r, http.StatusOK, counts)
+
+	httpReqs.Inc()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+const (
+	// maxBase64Input bounds the data accepted by /base64.
+	maxBase64Input = 64 * 1024
+	// maxHashBody bounds the request body digested by /hash.
+	maxHashBody = 16 * 1024 * 1024
+)
+
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func base64Handler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <base64Handler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	data := q.Get("data")
+	if len(data) > maxBase64Input {
+		rejectRequest(w, rejectBodyTooLarge, http.StatusRequestEntityTooLarge, fmt.Sprintf("data exceeds %d bytes", maxBase64Input))
+		return
+	}
+
+	var enc *base64.Encoding
+	switch q.Get("alphabet") {
+	case "", "std":
+		enc = base64.StdEncoding
+	case "url":
+		enc = base64.URLEncoding
+	default:
+		http.Error(w, "alphabet must be std or url", http.StatusBadRequest)
+		return
+	}
+
+	switch q.Get("op") {
+	case "", "encode":
+		fmt.Fprintf(w, "%s\n", enc.EncodeToString([]byte(data)))
+	case "decode":
+		decoded, err := enc.DecodeString(data)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid base64: %v", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s\n", decoded)
+	default:
+		http.Error(w, "op must be encode or decode", http.StatusBadRequest)
+		return
+	}
+
+	httpReqs.Inc()
+}
+
+// hashHandler streams the request body through the algorithm named by
+// ?algo= (sha256 by default) and returns the hex digest.
+func hashHandler(w http.ResponseWriter, r *http.Request) {
+	logFromCtx(r.Context()).Printf("%s <hashHandler>", getOnelineInfo(r))
+
+	if !checkQuery(w, r) {
+		return
+	}
+
+	algo := r.URL.Query().Get("algo")
+	if algo == "" {
+		algo = "sha256"
+	}
+	newHash, ok := hashAlgorithms[algo]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown algo %q: must be md5, sha1, sha256 or sha512", algo), http.StatusBadRequest)
+		return
+	}
+
+	h := newHash()
+	_, err := io.Copy(h, http.MaxBytesReader(w, r.Body, maxHashBody))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		rejectRequest(w, rejectBodyTooLarge, http.StatusRequestEntityTooLarge, fmt.Sprintf("body exceeds %d bytes", maxHashBody))
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading body: %v", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "%s\n", hex.EncodeToString(h.Sum(nil)))
+
+	httpReqs.Inc()
+}